@@ -0,0 +1,207 @@
+package capability
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+	"kernel.org/pub/linux/libs/security/libcap/psx"
+)
+
+var capabilities = map[string]uintptr{
+	"CAP_CHOWN":              unix.CAP_CHOWN,
+	"CAP_DAC_OVERRIDE":       unix.CAP_DAC_OVERRIDE,
+	"CAP_DAC_READ_SEARCH":    unix.CAP_DAC_READ_SEARCH,
+	"CAP_FOWNER":             unix.CAP_FOWNER,
+	"CAP_FSETID":             unix.CAP_FSETID,
+	"CAP_KILL":               unix.CAP_KILL,
+	"CAP_SETGID":             unix.CAP_SETGID,
+	"CAP_SETUID":             unix.CAP_SETUID,
+	"CAP_SETPCAP":            unix.CAP_SETPCAP,
+	"CAP_LINUX_IMMUTABLE":    unix.CAP_LINUX_IMMUTABLE,
+	"CAP_NET_BIND_SERVICE":   unix.CAP_NET_BIND_SERVICE,
+	"CAP_NET_BROADCAST":      unix.CAP_NET_BROADCAST,
+	"CAP_NET_ADMIN":          unix.CAP_NET_ADMIN,
+	"CAP_NET_RAW":            unix.CAP_NET_RAW,
+	"CAP_IPC_LOCK":           unix.CAP_IPC_LOCK,
+	"CAP_IPC_OWNER":          unix.CAP_IPC_OWNER,
+	"CAP_SYS_MODULE":         unix.CAP_SYS_MODULE,
+	"CAP_SYS_RAWIO":          unix.CAP_SYS_RAWIO,
+	"CAP_SYS_CHROOT":         unix.CAP_SYS_CHROOT,
+	"CAP_SYS_PTRACE":         unix.CAP_SYS_PTRACE,
+	"CAP_SYS_PACCT":          unix.CAP_SYS_PACCT,
+	"CAP_SYS_ADMIN":          unix.CAP_SYS_ADMIN,
+	"CAP_SYS_BOOT":           unix.CAP_SYS_BOOT,
+	"CAP_SYS_NICE":           unix.CAP_SYS_NICE,
+	"CAP_SYS_RESOURCE":       unix.CAP_SYS_RESOURCE,
+	"CAP_SYS_TIME":           unix.CAP_SYS_TIME,
+	"CAP_SYS_TTY_CONFIG":     unix.CAP_SYS_TTY_CONFIG,
+	"CAP_MKNOD":              unix.CAP_MKNOD,
+	"CAP_LEASE":              unix.CAP_LEASE,
+	"CAP_AUDIT_WRITE":        unix.CAP_AUDIT_WRITE,
+	"CAP_AUDIT_CONTROL":      unix.CAP_AUDIT_CONTROL,
+	"CAP_SETFCAP":            unix.CAP_SETFCAP,
+	"CAP_MAC_OVERRIDE":       unix.CAP_MAC_OVERRIDE,
+	"CAP_MAC_ADMIN":          unix.CAP_MAC_ADMIN,
+	"CAP_SYSLOG":             unix.CAP_SYSLOG,
+	"CAP_WAKE_ALARM":         unix.CAP_WAKE_ALARM,
+	"CAP_BLOCK_SUSPEND":      unix.CAP_BLOCK_SUSPEND,
+	"CAP_AUDIT_READ":         unix.CAP_AUDIT_READ,
+	"CAP_PERFMON":            unix.CAP_PERFMON,
+	"CAP_BPF":                unix.CAP_BPF,
+	"CAP_CHECKPOINT_RESTORE": unix.CAP_CHECKPOINT_RESTORE,
+}
+
+// Set lists the capabilities kept in each set by name, e.g. CAP_KILL.
+// Every set is empty by default so everything is dropped.
+type Set struct {
+	Bounding    []string `config:"bounding" yaml:"bounding" json:"bounding"`
+	Effective   []string `config:"effective" yaml:"effective" json:"effective"`
+	Permitted   []string `config:"permitted" yaml:"permitted" json:"permitted"`
+	Inheritable []string `config:"inheritable" yaml:"inheritable" json:"inheritable"`
+	Ambient     []string `config:"ambient" yaml:"ambient" json:"ambient"`
+}
+
+// Validate checks the names are known and that effective and ambient
+// capabilities are in the sets the kernel requires
+func (s Set) Validate() error {
+	for _, set := range [][]string{s.Bounding, s.Effective, s.Permitted, s.Inheritable, s.Ambient} {
+		for _, name := range set {
+			if _, ok := capabilities[canonical(name)]; !ok {
+				return fmt.Errorf("unknown capability '%s'", name)
+			}
+		}
+	}
+
+	for _, name := range s.Effective {
+		if !contains(s.Permitted, name) {
+			return fmt.Errorf("effective capability %s is not permitted", name)
+		}
+	}
+
+	// the kernel drops ambient capabilities missing from either set
+	for _, name := range s.Ambient {
+		if !contains(s.Permitted, name) || !contains(s.Inheritable, name) {
+			return fmt.Errorf("ambient capability %s must be permitted and inheritable", name)
+		}
+	}
+
+	return nil
+}
+
+// KeepOnSetuid keeps the permitted set when every uid turns non-zero
+func KeepOnSetuid() error {
+	if _, _, errno := psx.Syscall6(unix.SYS_PRCTL, unix.PR_SET_KEEPCAPS, 1, 0, 0, 0, 0); errno != 0 {
+		return fmt.Errorf("failed to keep capabilities %v", errno)
+	}
+
+	return nil
+}
+
+// Apply replaces the capabilities of every thread of the process, the
+// program inherits them across exec as far as its uid allows
+func (s Set) Apply() error {
+	hdr := unix.CapUserHeader{Version: unix.LINUX_CAPABILITY_VERSION_3}
+	var data [2]unix.CapUserData
+	if err := unix.Capget(&hdr, &data[0]); err != nil {
+		return fmt.Errorf("failed to get capabilities %v", err)
+	}
+
+	// setuid clears the effective set, what is permitted is enough
+	data[0].Effective, data[1].Effective = data[0].Permitted, data[1].Permitted
+	_, _, errno := psx.Syscall3(unix.SYS_CAPSET, uintptr(unsafe.Pointer(&hdr)), uintptr(unsafe.Pointer(&data[0])), 0)
+	if errno != 0 {
+		return fmt.Errorf("failed to raise capabilities %v", errno)
+	}
+
+	// the bounding set needs CAP_SETPCAP, it goes first
+	for c := uintptr(0); ; c++ {
+		// EINVAL past the last capability the kernel knows
+		if _, err := unix.PrctlRetInt(unix.PR_CAPBSET_READ, c, 0, 0, 0); err != nil {
+			break
+		}
+
+		if has(s.Bounding, c) {
+			continue
+		}
+
+		if _, _, errno := psx.Syscall6(unix.SYS_PRCTL, unix.PR_CAPBSET_DROP, c, 0, 0, 0, 0); errno != 0 {
+			return fmt.Errorf("failed to drop bounding capability %d %v", c, errno)
+		}
+	}
+
+	data = [2]unix.CapUserData{}
+	for name, c := range capabilities {
+		word, bit := c/32, uint32(1)<<(c%32)
+		if contains(s.Effective, name) {
+			data[word].Effective |= bit
+		}
+
+		if contains(s.Permitted, name) {
+			data[word].Permitted |= bit
+		}
+
+		if contains(s.Inheritable, name) {
+			data[word].Inheritable |= bit
+		}
+	}
+
+	_, _, errno = psx.Syscall3(unix.SYS_CAPSET, uintptr(unsafe.Pointer(&hdr)), uintptr(unsafe.Pointer(&data[0])), 0)
+	if errno != 0 {
+		return fmt.Errorf("failed to set capabilities %v", errno)
+	}
+
+	_, _, errno = psx.Syscall6(unix.SYS_PRCTL, unix.PR_CAP_AMBIENT, unix.PR_CAP_AMBIENT_CLEAR_ALL, 0, 0, 0, 0)
+	if errno != 0 {
+		return fmt.Errorf("failed to clear ambient capabilities %v", errno)
+	}
+
+	for _, name := range s.Ambient {
+		c := capabilities[canonical(name)]
+		_, _, errno := psx.Syscall6(unix.SYS_PRCTL, unix.PR_CAP_AMBIENT, unix.PR_CAP_AMBIENT_RAISE, c, 0, 0, 0)
+		if errno != 0 {
+			return fmt.Errorf("failed to raise ambient capability %s %v", name, errno)
+		}
+	}
+
+	return nil
+}
+
+// Bounding lists the capabilities in the bounding set of the calling thread
+func Bounding() []uintptr {
+	var caps []uintptr
+	for c := uintptr(0); ; c++ {
+		in, err := unix.PrctlRetInt(unix.PR_CAPBSET_READ, c, 0, 0, 0)
+		if err != nil {
+			return caps
+		}
+
+		if in == 1 {
+			caps = append(caps, c)
+		}
+	}
+}
+
+func has(set []string, c uintptr) bool {
+	return slices.ContainsFunc(set, func(name string) bool {
+		return capabilities[canonical(name)] == c
+	})
+}
+
+func contains(set []string, name string) bool {
+	return slices.ContainsFunc(set, func(other string) bool {
+		return canonical(other) == canonical(name)
+	})
+}
+
+// the CAP_ prefix is optional and case is ignored
+func canonical(name string) string {
+	name = strings.ToUpper(name)
+	if !strings.HasPrefix(name, "CAP_") {
+		name = "CAP_" + name
+	}
+
+	return name
+}
@@ -7,9 +7,12 @@ import (
 	"strconv"
 	"strings"
 	"syscall"
+	"time"
 
 	"codeberg.org/iklabib/kaleng/configs"
+	"codeberg.org/iklabib/kaleng/units"
 	"codeberg.org/iklabib/kaleng/util"
+	"golang.org/x/sys/unix"
 )
 
 var cgroupRoot string = "/sys/fs/cgroup"
@@ -30,6 +33,15 @@ type MemoryEvents struct {
 	OomGroupKill int
 }
 
+type Stats struct {
+	Memory     int64 // memory.current
+	MemoryPeak int64 // memory.peak, zero if unsupported
+	Pids       int   // pids.current
+	CpuUsage   time.Duration
+	CpuUser    time.Duration
+	CpuSystem  time.Duration
+}
+
 func New(name string) (*CGroup, error) {
 	dir := filepath.Join(cgroupRoot, name)
 
@@ -90,7 +102,47 @@ func (cg *CGroup) SetCpu(cpu configs.Cpu) {
 	}
 
 	if cpu.Time > 0 && cpu.Period > 0 {
-		err := cg.setControl("cpu.max", fmt.Sprintf("%d %d", cpu.Time, cpu.Period))
+		err := cg.setControl("cpu.max", fmt.Sprintf("%s %s", cpu.Time, cpu.Period))
+		util.Bail(err)
+	}
+}
+
+func (cg *CGroup) SetCpuset(cpuset configs.Cpuset) {
+	if cpuset.Cpus != "" {
+		err := cg.setControl("cpuset.cpus", cpuset.Cpus)
+		util.Bail(err)
+	}
+
+	if cpuset.Mems != "" {
+		err := cg.setControl("cpuset.mems", cpuset.Mems)
+		util.Bail(err)
+	}
+}
+
+func (cg *CGroup) SetIo(io configs.Io) {
+	if io.Weight > 0 {
+		err := cg.setControl("io.weight", fmt.Sprintf("default %d", io.Weight))
+		util.Bail(err)
+	}
+
+	for _, max := range io.Max {
+		dev, err := blockDevice(max.Device)
+		util.Bail(err)
+
+		var limits []string
+		keys := []string{"rbps", "wbps", "riops", "wiops"}
+		for i, val := range []units.Size{max.Rbps, max.Wbps, units.Size(max.Riops), units.Size(max.Wiops)} {
+			if val > 0 {
+				limits = append(limits, fmt.Sprintf("%s=%s", keys[i], val))
+			}
+		}
+
+		// no-op
+		if len(limits) == 0 {
+			continue
+		}
+
+		err = cg.setControl("io.max", dev+" "+strings.Join(limits, " "))
 		util.Bail(err)
 	}
 }
@@ -104,19 +156,39 @@ func (cg *CGroup) SetMaximumPids(lim int) {
 	util.Bail(err)
 }
 
-func (cg *CGroup) SetMaximumMemory(lim string) {
+func (cg *CGroup) SetMaximumMemory(lim units.Size) {
 	// no-op
-	if lim == "" {
+	if lim == 0 {
 		return
 	}
 
-	err := cg.setControl("memory.max", lim)
+	err := cg.setControl("memory.max", lim.String())
 	util.Bail(err)
 
 	err = cg.setControl("memory.oom.group", "1")
 	util.Bail(err)
 }
 
+func (cg *CGroup) SetMemoryHigh(lim units.Size) {
+	// no-op
+	if lim == 0 {
+		return
+	}
+
+	err := cg.setControl("memory.high", lim.String())
+	util.Bail(err)
+}
+
+func (cg *CGroup) SetMemoryLow(lim units.Size) {
+	// no-op
+	if lim == 0 {
+		return
+	}
+
+	err := cg.setControl("memory.low", lim.String())
+	util.Bail(err)
+}
+
 func (cg *CGroup) AddPid(pid int) error {
 	return cg.write("cgroup.procs", strconv.Itoa(pid))
 }
@@ -166,18 +238,26 @@ func (cg *CGroup) writeSubTreeControl(ctl string) error {
 	return nil
 }
 
-func (cg *CGroup) DisableSwap() error {
-	// disable swap
-	if err := cg.write("memory.swap.max", "0"); err != nil {
-		return err
+// disables swap when lim is default value and the controller supports it
+func (cg *CGroup) SetMaximumSwap(lim units.Size) {
+	if lim == 0 {
+		util.Bail(cg.write("memory.swap.max", "0"))
+		return
 	}
 
-	// disable zswap
-	if err := cg.write("memory.zswap.max", "0"); err != nil {
-		return err
+	err := cg.setControl("memory.swap.max", lim.String())
+	util.Bail(err)
+}
+
+// disables zswap when lim is default value and the controller supports it
+func (cg *CGroup) SetMaximumZswap(lim units.Size) {
+	if lim == 0 {
+		util.Bail(cg.write("memory.zswap.max", "0"))
+		return
 	}
 
-	return nil
+	err := cg.setControl("memory.zswap.max", lim.String())
+	util.Bail(err)
 }
 
 func (cg *CGroup) SetMaximumDescendants(lim int) {
@@ -208,8 +288,58 @@ func (cg *CGroup) CloseFd() error {
 	return syscall.Close(cg.fd)
 }
 
+// Kill kills every process of the group. cgroup.kill needs linux 5.14,
+// before that the pids in cgroup.procs are killed until none are left.
 func (cg *CGroup) Kill() error {
-	return cg.write("cgroup.kill", "1")
+	if _, err := os.Stat(filepath.Join(cg.fullPath, "cgroup.kill")); err == nil {
+		return cg.write("cgroup.kill", "1")
+	}
+
+	// forks racing the kill show up in the next round
+	for round := 0; round < killRounds; round++ {
+		pids, err := cg.procs()
+		if err != nil {
+			return err
+		}
+
+		if len(pids) == 0 {
+			return nil
+		}
+
+		for _, pid := range pids {
+			if err := syscall.Kill(pid, syscall.SIGKILL); err != nil && err != syscall.ESRCH {
+				return fmt.Errorf("failed to kill %d %v", pid, err)
+			}
+		}
+
+		time.Sleep(killInterval)
+	}
+
+	return fmt.Errorf("failed to kill every process of cgroup %s", cg.fullPath)
+}
+
+// how long Kill keeps at it without cgroup.kill
+const (
+	killRounds   = 100
+	killInterval = 10 * time.Millisecond
+)
+
+func (cg *CGroup) procs() ([]int, error) {
+	content, err := os.ReadFile(filepath.Join(cg.fullPath, "cgroup.procs"))
+	if err != nil {
+		return nil, err
+	}
+
+	var pids []int
+	for _, field := range strings.Fields(string(content)) {
+		pid, err := strconv.Atoi(field)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pid in cgroup.procs '%s'", field)
+		}
+		pids = append(pids, pid)
+	}
+
+	return pids, nil
 }
 
 func (cg *CGroup) write(name, lim string) error {
@@ -283,6 +413,72 @@ func (cg *CGroup) OomEvents() (MemoryEvents, error) {
 	return memEvents, nil
 }
 
+func (cg *CGroup) Stats() (Stats, error) {
+	var stats Stats
+
+	memory, err := cg.readInt("memory.current")
+	if err != nil {
+		return stats, err
+	}
+	stats.Memory = memory
+
+	pids, err := cg.readInt("pids.current")
+	if err != nil {
+		return stats, err
+	}
+	stats.Pids = int(pids)
+
+	// since linux 5.19
+	if peak, err := cg.readInt("memory.peak"); err == nil {
+		stats.MemoryPeak = peak
+	}
+
+	path := filepath.Join(cg.fullPath, "cpu.stat")
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return stats, err
+	}
+
+	for _, line := range strings.Split(strings.TrimSpace(string(content)), "\n") {
+		segments := strings.Split(line, " ")
+		if len(segments) != 2 {
+			continue
+		}
+
+		usec, err := strconv.ParseInt(segments[1], 10, 64)
+		if err != nil {
+			return stats, err
+		}
+
+		switch segments[0] {
+		case "usage_usec":
+			stats.CpuUsage = time.Duration(usec) * time.Microsecond
+		case "user_usec":
+			stats.CpuUser = time.Duration(usec) * time.Microsecond
+		case "system_usec":
+			stats.CpuSystem = time.Duration(usec) * time.Microsecond
+		}
+	}
+
+	return stats, nil
+}
+
+func (cg *CGroup) readInt(name string) (int64, error) {
+	path := filepath.Join(cg.fullPath, name)
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+
+	return strconv.ParseInt(strings.TrimSpace(string(content)), 10, 64)
+}
+
+// OomKilled reports whether the OOM killer took anything in the cgroup
+func (cg *CGroup) OomKilled() bool {
+	events, err := cg.OomEvents()
+	return err == nil && (events.OomKill > 0 || events.OomGroupKill > 0)
+}
+
 // check for cgroup violations
 func (cg *CGroup) Violations() []string {
 	var violations []string
@@ -295,13 +491,51 @@ func (cg *CGroup) Violations() []string {
 
 	if oomEvents, err := cg.OomEvents(); err != nil {
 		util.Bail(err)
-	} else if oomEvents.Oom > 0 || oomEvents.OomKill > 0 || oomEvents.OomGroupKill > 0 {
-		violations = append(violations, "memory restriction violated")
+	} else {
+		if oomEvents.Oom > 0 || oomEvents.OomKill > 0 || oomEvents.OomGroupKill > 0 {
+			violations = append(violations, "memory restriction violated")
+		}
+
+		if oomEvents.High > 0 {
+			violations = append(violations, "memory throttled by memory_high")
+		}
 	}
 
 	return violations
 }
 
+// blockDevice resolves path to the MAJ:MIN of the disk it belongs to, path
+// is either a block device or a file on a filesystem backed by one
+func blockDevice(path string) (string, error) {
+	var st syscall.Stat_t
+	if err := syscall.Stat(path, &st); err != nil {
+		return "", fmt.Errorf("failed to resolve device %s %v", path, err)
+	}
+
+	dev := st.Dev
+	if st.Mode&syscall.S_IFMT == syscall.S_IFBLK {
+		dev = st.Rdev
+	}
+
+	devNum := fmt.Sprintf("%d:%d", unix.Major(dev), unix.Minor(dev))
+
+	// io.max only takes whole disks, partitions resolve to their parent
+	sysPath, err := filepath.EvalSymlinks(filepath.Join("/sys/dev/block", devNum))
+	if err != nil {
+		return "", fmt.Errorf("%s is not on a block device %v", path, err)
+	}
+
+	if _, err := os.Stat(filepath.Join(sysPath, "partition")); err == nil {
+		content, err := os.ReadFile(filepath.Join(sysPath, "..", "dev"))
+		if err != nil {
+			return "", err
+		}
+		devNum = strings.TrimSpace(string(content))
+	}
+
+	return devNum, nil
+}
+
 func DeleteGroup(name string) error {
 	path := filepath.Join(cgroupRoot, name)
 	if err := os.RemoveAll(path); err != nil {
@@ -0,0 +1,135 @@
+package cgroup
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// lock files shared by every kaleng process on the host, kept out of the
+// world writable temp dir so nobody else can plant symlinks in it
+var cpusetLockDir = "/run/kaleng/cpuset"
+
+// how often a full pool is polled for a free cpu
+const cpusetPollInterval = 50 * time.Millisecond
+
+// AllocateCpu hands out a cpu from pool that no other run holds, blocking
+// until one is free, canceled returns true or wait passes. Zero wait blocks
+// until a cpu is free. The cpu stays allocated until the process exits.
+func AllocateCpu(pool string, wait time.Duration, canceled func() bool) (int, error) {
+	cpus, err := ParseCpuList(pool)
+	if err != nil {
+		return 0, err
+	}
+
+	if len(cpus) == 0 {
+		return 0, fmt.Errorf("empty cpuset pool")
+	}
+
+	if err := makeLockDir(); err != nil {
+		return 0, err
+	}
+
+	start := time.Now()
+	for {
+		for _, cpu := range cpus {
+			ok, err := lockCpu(cpu)
+			if err != nil {
+				return 0, err
+			}
+
+			if ok {
+				return cpu, nil
+			}
+		}
+
+		if canceled() {
+			return 0, fmt.Errorf("canceled while waiting for a cpu from pool %s", pool)
+		}
+
+		if wait > 0 && time.Since(start) >= wait {
+			return 0, fmt.Errorf("no free cpu in pool %s after %s", pool, wait)
+		}
+
+		time.Sleep(cpusetPollInterval)
+	}
+}
+
+// makeLockDir creates cpusetLockDir, refusing one that anybody but us could
+// have tampered with
+func makeLockDir() error {
+	if err := os.MkdirAll(cpusetLockDir, 0o755); err != nil {
+		return fmt.Errorf("failed to create cpuset lock dir %v", err)
+	}
+
+	for _, dir := range []string{filepath.Dir(cpusetLockDir), cpusetLockDir} {
+		var st syscall.Stat_t
+		if err := syscall.Lstat(dir, &st); err != nil {
+			return fmt.Errorf("failed to stat cpuset lock dir %v", err)
+		}
+
+		if st.Mode&syscall.S_IFMT != syscall.S_IFDIR || int(st.Uid) != os.Geteuid() || st.Mode&0o022 != 0 {
+			return fmt.Errorf("cpuset lock dir %s must be a directory only writable by uid %d", dir, os.Geteuid())
+		}
+	}
+
+	return nil
+}
+
+// the lock is released by the kernel when the process exits, so the fd is
+// deliberately leaked
+func lockCpu(cpu int) (bool, error) {
+	path := filepath.Join(cpusetLockDir, fmt.Sprintf("cpu%d.lock", cpu))
+	fd, err := syscall.Open(path, syscall.O_CREAT|syscall.O_RDWR|syscall.O_CLOEXEC|syscall.O_NOFOLLOW, 0o644)
+	if err != nil {
+		return false, fmt.Errorf("failed to open cpuset lock %v", err)
+	}
+
+	err = syscall.Flock(fd, syscall.LOCK_EX|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		syscall.Close(fd)
+		return false, nil
+	}
+
+	if err != nil {
+		syscall.Close(fd)
+		return false, err
+	}
+
+	return true, nil
+}
+
+// ParseCpuList parses the cpuset list format, e.g. 0-3,6
+func ParseCpuList(list string) ([]int, error) {
+	var cpus []int
+	for _, part := range strings.Split(list, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		first, last, isRange := strings.Cut(part, "-")
+		start, err := strconv.Atoi(first)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cpu list %s", list)
+		}
+
+		end := start
+		if isRange {
+			end, err = strconv.Atoi(last)
+			if err != nil || end < start {
+				return nil, fmt.Errorf("invalid cpu list %s", list)
+			}
+		}
+
+		for cpu := start; cpu <= end; cpu++ {
+			cpus = append(cpus, cpu)
+		}
+	}
+
+	return cpus, nil
+}
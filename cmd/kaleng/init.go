@@ -0,0 +1,234 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"codeberg.org/iklabib/kaleng/model"
+	"codeberg.org/iklabib/kaleng/restrict"
+	"codeberg.org/iklabib/kaleng/util"
+	"github.com/alecthomas/kong"
+	"golang.org/x/sys/unix"
+)
+
+// initProcess is started by setup as PID 1 of the run's PID namespace. It
+// applies the restrictions, runs the program, reaps orphans and kills
+// whatever is left once the program exits.
+func initProcess() {
+	// util.Bail leaves through runtime.Goexit
+	defer os.Exit(1)
+	var cli CLI
+	kong.Parse(&cli)
+
+	// orphans are reparented to us even without a PID namespace, set before
+	// the seccomp filter of Setup can block prctl
+	util.Bail(unix.Prctl(unix.PR_SET_CHILD_SUBREAPER, 1, 0, 0, 0))
+
+	// the time limit is enforced by the supervisor
+	restrict.Setup(envId("KALENG_UID"), envId("KALENG_GID"), cli.Execute.Cwd)
+	executable := cli.Execute.Args[0]
+	args := cli.Execute.Args[1:]
+
+	execute(executable, args, cli.Execute.Tty)
+}
+
+// ids resolved by the supervisor for rootful runs come through the
+// environment, a flag would be overridden by one in the program's args
+func envId(name string) int {
+	value, ok := os.LookupEnv(name)
+	if !ok {
+		return 0
+	}
+
+	id, err := strconv.Atoi(value)
+	if err != nil {
+		util.MessageBail(fmt.Sprintf("invalid %s '%s'", name, value))
+	}
+
+	return id
+}
+
+func execute(executable string, args []string, tty bool) {
+	// subscribe before start so an early exit is not missed
+	sigs := make(chan os.Signal, 8)
+	signal.Notify(sigs, append(forwardedSignals, syscall.SIGCHLD)...)
+
+	cmd := exec.Command(executable, args...)
+	files := stdioFiles(tty)
+	if tty {
+		cmd.Stdin = files[0]
+		cmd.Stdout = files[0]
+		cmd.Stderr = files[0]
+		cmd.SysProcAttr = &syscall.SysProcAttr{
+			Setsid:  true,
+			Setctty: true,
+			Ctty:    0, // stdin
+		}
+	} else {
+		cmd.Stdout = files[0]
+		cmd.Stderr = files[1]
+		cmd.SysProcAttr = &syscall.SysProcAttr{
+			Setpgid: true,
+		}
+	}
+
+	start := time.Now()
+	util.Bail(cmd.Start())
+	pid := cmd.Process.Pid
+
+	var status syscall.WaitStatus
+	var usage syscall.Rusage
+	for exited := false; !exited; {
+		sig := <-sigs
+		if sig != syscall.SIGCHLD {
+			// the program leads its own process group
+			syscall.Kill(-pid, sig.(syscall.Signal))
+			continue
+		}
+
+		exited = reap(pid, &status, &usage)
+	}
+	wallTime := time.Since(start)
+
+	signal.Stop(sigs)
+	killAll(pid)
+
+	metrics := model.Metrics{
+		WallTime: wallTime,
+		ExitCode: status.ExitStatus(),
+		UserTime: time.Duration(usage.Utime.Nano()), // ns
+		SysTime:  time.Duration(usage.Stime.Nano()), // ns
+		Memory:   usage.Maxrss,                      // kb
+	}
+
+	if status.Signaled() {
+		metrics.Signal = status.Signal()
+	}
+
+	// output is collected by the supervisor
+	result := model.Result{
+		Metric: metrics,
+	}
+
+	// SIGSYS likely caused by seccomp violation
+	if metrics.Signal == syscall.SIGSYS {
+		result.Message = append(result.Message, "security restriction violated")
+	}
+
+	if message := rlimitViolation(metrics); message != "" {
+		result.Message = append(result.Message, message)
+	}
+
+	marshaled, err := json.Marshal(result)
+	util.Bail(err)
+
+	fmt.Println(string(marshaled))
+
+	os.Exit(metrics.ExitCode)
+}
+
+// verdict for a program stopped by its rlimits, the limits applied to init
+// are the ones the program inherited
+func rlimitViolation(metrics model.Metrics) string {
+	switch metrics.Signal {
+	case syscall.SIGXCPU:
+		return "cpu time limit exceeded"
+	case syscall.SIGXFSZ:
+		return "file size limit exceeded"
+	case syscall.SIGKILL:
+		// past the hard RLIMIT_CPU the kernel sends SIGKILL instead, the
+		// rusage may fall a tick short of it so compare against the soft limit
+		var cpu unix.Rlimit
+		if err := unix.Getrlimit(unix.RLIMIT_CPU, &cpu); err != nil || cpu.Cur == unix.RLIM_INFINITY {
+			return ""
+		}
+
+		used := metrics.UserTime + metrics.SysTime
+		if used >= time.Duration(cpu.Cur)*time.Second {
+			return "cpu time limit exceeded"
+		}
+	}
+
+	return ""
+}
+
+// reap every exited child, reports whether pid was among them
+func reap(pid int, status *syscall.WaitStatus, usage *syscall.Rusage) bool {
+	found := false
+	for {
+		var ws syscall.WaitStatus
+		var ru syscall.Rusage
+		wpid, err := syscall.Wait4(-1, &ws, syscall.WNOHANG, &ru)
+		if errors.Is(err, syscall.EINTR) {
+			continue
+		}
+
+		if err != nil || wpid <= 0 {
+			return found
+		}
+
+		// orphans are reaped without accounting
+		if wpid == pid {
+			*status, *usage = ws, ru
+			found = true
+		}
+	}
+}
+
+// kill and reap the rest of the tree once the program has exited
+func killAll(pid int) {
+	syscall.Kill(-pid, syscall.SIGKILL)
+
+	for {
+		if os.Getpid() == 1 {
+			// everything else in the namespace
+			syscall.Kill(-1, syscall.SIGKILL)
+		} else {
+			pids := children()
+			// nothing visible, the supervisor kills the cgroup
+			if len(pids) == 0 {
+				return
+			}
+
+			for _, child := range pids {
+				syscall.Kill(child, syscall.SIGKILL)
+			}
+		}
+
+		_, err := syscall.Wait4(-1, nil, 0, nil)
+		if errors.Is(err, syscall.ECHILD) {
+			return
+		}
+	}
+}
+
+// direct children of this process, grandchildren are reparented here as
+// their parents die
+func children() []int {
+	paths, _ := filepath.Glob("/proc/self/task/*/children")
+
+	var pids []int
+	for _, path := range paths {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+
+		for _, field := range strings.Fields(string(content)) {
+			if pid, err := strconv.Atoi(field); err == nil {
+				pids = append(pids, pid)
+			}
+		}
+	}
+
+	return pids
+}
@@ -2,19 +2,22 @@ package main
 
 import (
 	"bytes"
-	"context"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"io"
 	"os"
-	"os/exec"
+	"runtime"
+	"slices"
+	"sync"
 	"syscall"
 	"time"
 
+	"codeberg.org/iklabib/kaleng/capability"
+	"codeberg.org/iklabib/kaleng/cgroup"
 	"codeberg.org/iklabib/kaleng/configs"
 	"codeberg.org/iklabib/kaleng/model"
 	"codeberg.org/iklabib/kaleng/restrict"
+	"codeberg.org/iklabib/kaleng/schema"
 	"codeberg.org/iklabib/kaleng/util"
 	"codeberg.org/iklabib/kaleng/util/reexec"
 	"github.com/alecthomas/kong"
@@ -23,172 +26,336 @@ import (
 func main() {
 	defer os.Exit(0)
 	var cli CLI
-	kong.Parse(&cli)
+	ctx := kong.Parse(&cli)
+	if ctx.Command() == "schema <kind>" {
+		printSchema(cli.Schema.Kind)
+		return
+	}
 
-	buf, err := os.ReadFile(cli.Execute.Config)
+	util.Report = earlyReport(cli)
+	buf, err := restrict.ReadConfig(cli.Execute.Config, cli.Execute.Set)
 	util.Bail(err)
 
 	config, err := restrict.Config(buf)
 	util.Bail(err)
 
-	restrict.PreChroot(cli.Execute.Root, config.Binds)
+	if config.Deterministic && config.Seed == 0 {
+		config.Seed = uint64(util.RandomNumber(0))<<32 | uint64(util.RandomNumber(0))
+	}
 
-	stdout, violations := execSetup(cli.Execute.Root, bytes.NewBuffer(buf), config)
-	defer restrict.CleanChroot(cli.Execute.Root, config.Binds)
+	cancel := watchTermination()
+	restrict.PreChroot(cli.Execute.Root, config)
+	// also cleans up when waiting for a cpu is canceled
+	defer restrict.CleanChroot(cli.Execute.Root, config)
+	stopRandom := func() {}
+	if config.Deterministic {
+		stopRandom = restrict.ServeRandom(cli.Execute.Root, config.Seed)
+	}
 
-	if len(violations) == 0 {
-		fmt.Print(stdout.String())
-	} else {
-		var result model.Result
-		err = json.Unmarshal(stdout.Bytes(), &result)
-		util.Bail(err)
+	cg := restrict.CGroup(cli.Execute.Root, config.Cgroup, cancel.Canceled)
+	cancel.Arm(cg)
+	sess := newSession(cli, cg)
+	util.Report = sess.Finish
 
-		result.Message = append(result.Message, violations...)
+	stdout, warnings, wallTime, timedOut := execSetup(bytes.NewBuffer(buf), config, cg, sess, cancel)
+	stopRandom()
 
-		content, err := json.Marshal(result)
-		util.Bail(err)
+	var result model.Result
+	if err := json.Unmarshal(stdout.Bytes(), &result); err != nil {
+		// memory.oom.group takes setup down with the program
+		if !cancel.Canceled() && !timedOut && !cg.OomKilled() {
+			util.Bail(err)
+		}
 
-		fmt.Println(string(content))
+		// setup was killed along with the run
+		result = killedResult(cg, wallTime)
+		if cancel.Canceled() {
+			result.Message = append(result.Message, "canceled")
+		}
+	}
+
+	// e.g. the fallback to chroot
+	for _, warning := range warnings {
+		result.Message = append(result.Message, "warning: "+warning)
 	}
+
+	if timedOut {
+		result.Message = append(result.Message, "time limit exceeded")
+	}
+
+	// setup failures are reported through Output
+	result.Output = sess.Output() + result.Output
+	result.Message = append(result.Message, cg.Violations()...)
+	if config.Deterministic {
+		result.Seed = config.Seed
+	}
+
+	sess.Finish(result)
 }
 
 func init() {
 	reexec.Register("setup", setup)
+	reexec.Register("init", initProcess)
 	if reexec.Init() {
 		os.Exit(0)
 	}
 }
 
+// setup runs inside the namespaces and enters the root, it starts init in
+// a fresh PID namespace and relays its result
 func setup() {
+	// util.Bail leaves through runtime.Goexit
+	defer os.Exit(1)
 	var cli CLI
 	kong.Parse(&cli)
 
-	config := restrict.Setup()
-	executable := cli.Execute.Args[0]
-	args := cli.Execute.Args[1:]
+	buf, err := io.ReadAll(os.Stdin)
+	util.Bail(err)
+
+	config, err := restrict.Config(buf)
+	util.Bail(err)
+
+	restrict.EnterRoot(cli.Execute.Root, config.Namespaces)
+
+	// reexec runs us from init on the main thread, the TIME namespace is
+	// unshared for its children
+	runtime.LockOSThread()
+	restrict.SetHostname(config)
+	if slices.Contains(config.Namespaces, "TIME") {
+		restrict.UnshareTime(config.TimeOffsets)
+	}
 
-	execute(executable, args, config.TimeLimit)
+	args := append([]string{"init"}, os.Args[1:]...)
+	cmd := reexec.Command(args...)
+	var stdout bytes.Buffer
+	cmd.Stdin = bytes.NewReader(buf)
+	cmd.Stdout = &stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = stdioFiles(cli.Execute.Tty)
+
+	// the namespace dies with init, init dies with us
+	cmd.SysProcAttr.Pdeathsig = syscall.SIGKILL
+	if slices.Contains(config.Namespaces, "PID") {
+		cmd.SysProcAttr.Cloneflags = syscall.CLONE_NEWPID
+	}
+
+	util.Bail(cmd.Start())
+	stop := forwardSignals(cmd.Process, forwardedSignals...)
+	cmd.Wait()
+	stop()
+
+	if stdout.Len() == 0 {
+		util.MessageBail(fmt.Sprintf("init failed: %s", cmd.ProcessState))
+	}
+
+	fmt.Print(stdout.String())
+	os.Exit(cmd.ProcessState.ExitCode())
 }
 
-func execute(executable string, args []string, timeLimit int) {
-	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(timeLimit)*time.Second)
-	defer cancel()
+func execSetup(stdin io.Reader, config configs.KalengConfig, cg *cgroup.CGroup, sess session, cancel *canceler) (bytes.Buffer, []string, time.Duration, bool) {
+	defer cg.CloseFd()
+
+	// main cleans the root up on the way out
+	uid, err := util.LookupUser(config.User)
+	util.Bail(err)
+
+	gid, err := util.LookupGroup(config.Group)
+	util.Bail(err)
+
+	if config.Rootful && os.Getuid() != 0 {
+		util.MessageBail("rootful mode needs root")
+	}
+
+	uidMappings, gidMappings, credential, err := idMappings(config, uid, gid)
+	util.Bail(err)
+
+	args := append([]string{"setup"}, os.Args[1:]...)
+	cmd := reexec.Command(args...)
+	var stdout bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stdin = stdin
+	// warnings of setup and init go to the result, e.g. a degraded landlock
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		GidMappingsEnableSetgroups: true,
+		UidMappings:                uidMappings,
+		GidMappings:                gidMappings,
+		Credential:                 credential,
+		UseCgroupFD:                true,
+		CgroupFD:                   cg.GetFD(),
+		// PID and TIME namespaces are created by setup for init
+		Cloneflags: restrict.GetNamespaceFlag(config.Namespaces, config.Rootful) &^ (syscall.CLONE_NEWPID | syscall.CLONE_NEWTIME),
+	}
+
+	if config.Rootful {
+		// setup and init stay root, init drops to uid and gid before exec
+		cmd.Env = append(os.Environ(), fmt.Sprintf("KALENG_UID=%d", uid), fmt.Sprintf("KALENG_GID=%d", gid))
+	} else {
+		// setup and init run as User, ambient capabilities keep them
+		// privileged across exec until init applies config.Capabilities
+		cmd.SysProcAttr.AmbientCaps = capability.Bounding()
+	}
 
-	cmd := exec.CommandContext(ctx, executable, args...)
-	var output bytes.Buffer
-	cmd.Stdout = &output
-	cmd.Stderr = &output
+	cmd.ExtraFiles = sess.Files()
 
 	start := time.Now()
 	util.Bail(cmd.Start())
+	cancel.Check()
+	sess.Start(cmd.Process)
+
+	limit := time.Duration(config.TimeLimit)
+	grace := time.Duration(config.GracePeriod)
+	stopLimit := enforceTimeLimit(cmd.Process, cg, limit, grace)
 
 	cmd.Wait()
 	wallTime := time.Since(start)
+	timedOut := stopLimit()
 
-	procState := cmd.ProcessState
-	usage, ok := procState.SysUsage().(*syscall.Rusage)
-	if !ok {
-		util.MessageBail("failed to get usage")
-	}
+	// stragglers would keep the output open
+	cg.Kill()
+	sess.Wait()
 
-	metrics := model.Metrics{
-		WallTime: wallTime,
-		ExitCode: procState.ExitCode(),
-		UserTime: time.Duration(usage.Utime.Nano()), // ns
-		SysTime:  time.Duration(usage.Stime.Nano()), // ns
-		Memory:   usage.Maxrss,                      // kb
+	warnings, rest := util.SplitWarnings(stderr.String())
+	fmt.Fprint(os.Stderr, rest)
+
+	return stdout, warnings, wallTime, timedOut
+}
+
+// idMappings maps only our ids to uid and gid by default. Configured
+// ranges are written as is, we run as root so newuidmap is not needed, and
+// setup switches to uid and gid once they apply. Subordinate ranges are
+// those User is granted, not root's.
+func idMappings(config configs.KalengConfig, uid, gid int) ([]syscall.SysProcIDMap, []syscall.SysProcIDMap, *syscall.Credential, error) {
+	// no USER namespace to map into
+	if config.Rootful {
+		if len(config.UidMappings) > 0 || len(config.GidMappings) > 0 {
+			return nil, nil, nil, fmt.Errorf("id mappings need a USER namespace, not rootful mode")
+		}
+
+		return nil, nil, nil, nil
 	}
 
-	result := model.Result{
-		Metric: metrics,
-		Output: output.String(),
+	uidMappings := []syscall.SysProcIDMap{{HostID: os.Getuid(), ContainerID: uid, Size: 1}}
+	gidMappings := []syscall.SysProcIDMap{{HostID: os.Getgid(), ContainerID: gid, Size: 1}}
+	if len(config.UidMappings) == 0 && len(config.GidMappings) == 0 {
+		return uidMappings, gidMappings, nil, nil
 	}
 
-	if err := ctx.Err(); err != nil {
-		if errors.Is(err, context.DeadlineExceeded) {
-			result.Message = append(result.Message, "time limit exceeded")
-		} else if errors.Is(err, context.Canceled) {
-			result.Message = append(result.Message, "canceled")
-		} else {
-			result.Message = append(result.Message, err.Error())
+	var err error
+	if len(config.UidMappings) > 0 {
+		uidMappings, err = util.IdMappings(config.UidMappings, uid, util.SubuidFile, config.User)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("uid_mappings: %s", err.Error())
 		}
 	}
 
-	if !procState.Exited() {
-		wt := procState.Sys().(syscall.WaitStatus)
-		if wt.Signaled() {
-			metrics.Signal = wt.Signal()
+	if len(config.GidMappings) > 0 {
+		gidMappings, err = util.IdMappings(config.GidMappings, gid, util.SubgidFile, config.User)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("gid_mappings: %s", err.Error())
 		}
 	}
 
-	// SIGSYS likely caused by seccomp violation
-	if metrics.Signal == syscall.SIGSYS {
-		result.Message = append(result.Message, "security restriction violated")
+	credential := &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)}
+	return uidMappings, gidMappings, credential, nil
+}
+
+// enforceTimeLimit kills the whole cgroup once limit passes, counted from
+// setup start so preparing the sandbox counts too. With a grace period
+// setup gets SIGTERM first, which is relayed down to the program.
+// The returned func stops enforcement and reports whether limit was hit.
+func enforceTimeLimit(proc *os.Process, cg *cgroup.CGroup, limit, grace time.Duration) func() bool {
+	// no-op
+	if limit <= 0 {
+		return func() bool { return false }
 	}
 
-	marshaled, err := json.Marshal(result)
-	util.Bail(err)
+	var mu sync.Mutex
+	var kill *time.Timer
+	exceeded := false
 
-	fmt.Println(string(marshaled))
+	term := time.AfterFunc(limit, func() {
+		mu.Lock()
+		defer mu.Unlock()
 
-	os.Exit(procState.ExitCode())
-}
+		exceeded = true
+		if grace <= 0 {
+			cg.Kill()
+			return
+		}
 
-func execSetup(root string, stdin io.Reader, config configs.KalengConfig) (bytes.Buffer, []string) {
-	cg := restrict.CGroup(root, config.Cgroup)
-	defer cg.CloseFd()
+		proc.Signal(syscall.SIGTERM)
+		kill = time.AfterFunc(grace, func() {
+			cg.Kill()
+		})
+	})
 
-	uid, err := util.LookupUser(config.User)
-	if err != nil {
-		fmt.Println(err.Error())
-		restrict.CleanChroot(root, config.Binds)
-		os.Exit(1)
+	return func() bool {
+		term.Stop()
+
+		mu.Lock()
+		defer mu.Unlock()
+
+		if kill != nil {
+			kill.Stop()
+		}
+
+		return exceeded
 	}
+}
 
-	gid, err := util.LookupGroup(config.Group)
-	if err != nil {
-		fmt.Println(err.Error())
-		restrict.CleanChroot(root, config.Binds)
-		os.Exit(1)
+// result of a run that was killed before setup could report, the metrics
+// are taken from its cgroup
+func killedResult(cg *cgroup.CGroup, wallTime time.Duration) model.Result {
+	metrics := model.Metrics{
+		Signal:   syscall.SIGKILL,
+		ExitCode: -1,
+		WallTime: wallTime,
 	}
 
-	args := append([]string{"setup"}, os.Args[1:]...)
-	cmd := reexec.Command(args...)
-	var stdout bytes.Buffer
-	cmd.Stdout = &stdout
-	cmd.Stdin = stdin
-	cmd.SysProcAttr = &syscall.SysProcAttr{
-		Chroot:                     root,
-		GidMappingsEnableSetgroups: true,
-		UidMappings: []syscall.SysProcIDMap{
-			{
-				HostID:      os.Getuid(),
-				ContainerID: uid,
-				Size:        1,
-			},
-		},
-		GidMappings: []syscall.SysProcIDMap{
-			{
-				HostID:      os.Getgid(),
-				ContainerID: gid,
-				Size:        1,
-			},
-		},
-		UseCgroupFD: true,
-		CgroupFD:    cg.GetFD(),
-		Cloneflags:  restrict.GetNamespaceFlag(config.Namespaces),
+	if stats, err := cg.Stats(); err == nil {
+		metrics.UserTime = stats.CpuUser
+		metrics.SysTime = stats.CpuSystem
+		metrics.Memory = stats.MemoryPeak / 1024 // kb
 	}
 
-	util.Bail(cmd.Start())
-	cmd.Wait()
+	return model.Result{Metric: metrics}
+}
+
+// Validate rejects flag values the run cannot work with
+func (cli *CLI) Validate() error {
+	// time.NewTicker panics otherwise
+	if cli.Execute.SampleInterval <= 0 {
+		return fmt.Errorf("--sample-interval must be positive")
+	}
 
-	return stdout, cg.Violations()
+	return nil
 }
 
 type CLI struct {
 	Execute struct {
-		Root   string
-		Config string
-		Args   []string `arg:"" passthrough:""`
+		Root           string
+		Config         string
+		Set            []string      `help:"Override a config value, e.g. cgroup.max_memory=256M." placeholder:"KEY=VALUE" sep:"none"`
+		Tty            bool          `help:"Run the program on a pseudo-terminal wired to stdin and stdout, the result is written to stderr." xor:"mode"`
+		Stream         bool          `help:"Write newline-delimited JSON events to stdout while the program runs." xor:"mode"`
+		SampleInterval time.Duration `help:"Interval between resource samples in stream mode." default:"250ms"`
+		Cwd            string        `help:"Working directory of the program, overrides workdir."`
+		Args           []string      `arg:"" passthrough:""`
 	} `cmd:""`
+	Schema struct {
+		Kind string `arg:"" enum:"config,result" help:"Either config or result."`
+	} `cmd:"" help:"Print the JSON Schema of the config or the result."`
+}
+
+func printSchema(kind string) {
+	s := schema.Config()
+	if kind == "result" {
+		s = schema.Result()
+	}
+
+	buf, err := json.MarshalIndent(s, "", "  ")
+	util.Bail(err)
+	fmt.Println(string(buf))
 }
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"syscall"
+
+	"codeberg.org/iklabib/kaleng/cgroup"
+	"codeberg.org/iklabib/kaleng/model"
+	"codeberg.org/iklabib/kaleng/util"
+)
+
+// fds of the program stdio in the setup child, see execSetup
+const (
+	stdoutFd = 3
+	stderrFd = 4
+	ttyFd    = 3
+)
+
+// stdio of the program as inherited from the supervisor
+func stdioFiles(tty bool) []*os.File {
+	if tty {
+		syscall.CloseOnExec(ttyFd)
+		return []*os.File{os.NewFile(ttyFd, "tty")}
+	}
+
+	syscall.CloseOnExec(stdoutFd)
+	syscall.CloseOnExec(stderrFd)
+	return []*os.File{
+		os.NewFile(stdoutFd, "stdout"),
+		os.NewFile(stderrFd, "stderr"),
+	}
+}
+
+// session owns the stdio of a run and reports its result
+type session interface {
+	// handed to the setup child starting from fd 3
+	Files() []*os.File
+	Start(proc *os.Process)
+	Wait()
+	Output() string
+	Finish(result model.Result)
+}
+
+func newSession(cli CLI, cg *cgroup.CGroup) session {
+	switch {
+	case cli.Execute.Tty:
+		return openTty()
+	case cli.Execute.Stream:
+		return openStream(cg, cli.Execute.SampleInterval)
+	default:
+		return openBuffer()
+	}
+}
+
+// failures before the session opens are reported the way it would
+func earlyReport(cli CLI) func(model.Result) {
+	switch {
+	case cli.Execute.Tty:
+		return (&ttySession{}).Finish
+	case cli.Execute.Stream:
+		return (&streamSession{enc: json.NewEncoder(os.Stdout)}).Finish
+	default:
+		return (&bufferSession{}).Finish
+	}
+}
+
+// bufferSession collects stdout and stderr for the final result
+type bufferSession struct {
+	r, w   *os.File
+	output bytes.Buffer
+	done   chan struct{}
+}
+
+func openBuffer() *bufferSession {
+	r, w, err := os.Pipe()
+	util.Bail(err)
+
+	return &bufferSession{
+		r:    r,
+		w:    w,
+		done: make(chan struct{}),
+	}
+}
+
+func (s *bufferSession) Files() []*os.File {
+	// stdout and stderr share the pipe to keep them interleaved
+	return []*os.File{s.w, s.w}
+}
+
+func (s *bufferSession) Start(proc *os.Process) {
+	s.w.Close()
+
+	go func() {
+		io.Copy(&s.output, s.r)
+		close(s.done)
+	}()
+}
+
+func (s *bufferSession) Wait() {
+	<-s.done
+	s.r.Close()
+}
+
+func (s *bufferSession) Output() string {
+	return s.output.String()
+}
+
+func (s *bufferSession) Finish(result model.Result) {
+	content, err := json.Marshal(result)
+	util.Bail(err)
+
+	fmt.Println(string(content))
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"codeberg.org/iklabib/kaleng/cgroup"
+)
+
+// signals that cancel the run in the supervisor
+var terminationSignals = []os.Signal{
+	syscall.SIGINT,
+	syscall.SIGTERM,
+	syscall.SIGHUP,
+}
+
+// signals relayed from setup down to the program
+var forwardedSignals = []os.Signal{
+	syscall.SIGINT,
+	syscall.SIGTERM,
+	syscall.SIGHUP,
+	syscall.SIGQUIT,
+	syscall.SIGUSR1,
+	syscall.SIGUSR2,
+}
+
+// canceler kills the run's cgroup when the supervisor is asked to
+// terminate. The signals stay caught until exit so cleanup is not cut short.
+type canceler struct {
+	sigs chan os.Signal
+
+	mu       sync.Mutex
+	cg       *cgroup.CGroup
+	canceled bool
+}
+
+func watchTermination() *canceler {
+	c := &canceler{sigs: make(chan os.Signal, 1)}
+	signal.Notify(c.sigs, terminationSignals...)
+
+	go func() {
+		for range c.sigs {
+			c.mu.Lock()
+			c.canceled = true
+			if c.cg != nil {
+				c.cg.Kill()
+			}
+			c.mu.Unlock()
+		}
+	}()
+
+	return c
+}
+
+// Arm kills cg on termination from now on
+func (c *canceler) Arm(cg *cgroup.CGroup) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.cg = cg
+}
+
+// Check kills the armed cgroup if termination was already requested, for
+// processes started after the signal arrived.
+func (c *canceler) Check() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.canceled && c.cg != nil {
+		c.cg.Kill()
+	}
+}
+
+func (c *canceler) Canceled() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.canceled
+}
+
+// relay signals to proc until the returned func is called
+func forwardSignals(proc *os.Process, signals ...os.Signal) func() {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, signals...)
+
+	go func() {
+		for sig := range sigs {
+			proc.Signal(sig)
+		}
+	}()
+
+	return func() {
+		signal.Stop(sigs)
+		close(sigs)
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"codeberg.org/iklabib/kaleng/cgroup"
+	"codeberg.org/iklabib/kaleng/model"
+	"codeberg.org/iklabib/kaleng/util"
+)
+
+// streamSession writes newline-delimited model.Event to stdout while
+// the program runs
+type streamSession struct {
+	cg       *cgroup.CGroup
+	interval time.Duration
+	stdout   [2]*os.File // read, write
+	stderr   [2]*os.File
+
+	mu         sync.Mutex
+	enc        *json.Encoder
+	start      time.Time
+	output     bytes.Buffer // stdout + stderr
+	violations []string     // already emitted
+
+	readers sync.WaitGroup
+	stop    chan struct{}
+	stopped chan struct{}
+}
+
+func openStream(cg *cgroup.CGroup, interval time.Duration) *streamSession {
+	s := &streamSession{
+		cg:       cg,
+		interval: interval,
+		enc:      json.NewEncoder(os.Stdout),
+		stop:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+
+	for _, p := range []*[2]*os.File{&s.stdout, &s.stderr} {
+		r, w, err := os.Pipe()
+		util.Bail(err)
+		p[0], p[1] = r, w
+	}
+
+	return s
+}
+
+func (s *streamSession) Files() []*os.File {
+	return []*os.File{s.stdout[1], s.stderr[1]}
+}
+
+func (s *streamSession) Start(proc *os.Process) {
+	s.stdout[1].Close()
+	s.stderr[1].Close()
+
+	s.start = time.Now()
+	s.emit(model.Event{Type: model.EventStarted})
+
+	s.readers.Add(2)
+	go s.forward(s.stdout[0], model.EventStdout)
+	go s.forward(s.stderr[0], model.EventStderr)
+	go s.sample()
+}
+
+func (s *streamSession) Wait() {
+	s.readers.Wait()
+	s.stdout[0].Close()
+	s.stderr[0].Close()
+
+	close(s.stop)
+	<-s.stopped
+
+	// violations that were not caught while sampling
+	for _, msg := range s.cg.Violations() {
+		s.violation(msg)
+	}
+}
+
+func (s *streamSession) Output() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.output.String()
+}
+
+func (s *streamSession) Finish(result model.Result) {
+	s.emit(model.Event{Type: model.EventExited, Result: &result})
+}
+
+func (s *streamSession) forward(r *os.File, kind string) {
+	defer s.readers.Done()
+
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			s.mu.Lock()
+			s.output.Write(buf[:n])
+			s.mu.Unlock()
+
+			s.emit(model.Event{Type: kind, Data: string(buf[:n])})
+		}
+
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (s *streamSession) sample() {
+	defer close(s.stopped)
+
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+		}
+
+		// the cgroup may be gone with the run, skip the sample
+		stats, err := s.cg.Stats()
+		if err != nil {
+			continue
+		}
+
+		s.emit(model.Event{
+			Type: model.EventSample,
+			Sample: &model.Sample{
+				Memory:  stats.Memory,
+				Pids:    stats.Pids,
+				CpuTime: stats.CpuUsage,
+			},
+		})
+
+		for _, msg := range s.cg.Violations() {
+			s.violation(msg)
+		}
+	}
+}
+
+// emit a violation event once per message
+func (s *streamSession) violation(msg string) {
+	s.mu.Lock()
+	seen := slices.Contains(s.violations, msg)
+	if !seen {
+		s.violations = append(s.violations, msg)
+	}
+	s.mu.Unlock()
+
+	if !seen {
+		s.emit(model.Event{Type: model.EventViolation, Message: msg})
+	}
+}
+
+func (s *streamSession) emit(event model.Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.start.IsZero() {
+		event.Elapsed = time.Since(s.start)
+	}
+
+	// stdout is gone, there is nobody left to tell
+	s.enc.Encode(event)
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"codeberg.org/iklabib/kaleng/model"
+	"codeberg.org/iklabib/kaleng/util"
+	"codeberg.org/iklabib/kaleng/util/pty"
+	"golang.org/x/sys/unix"
+)
+
+// ttySession runs the program on a pseudo-terminal wired to the caller's
+// stdin and stdout, the result goes to stderr
+type ttySession struct {
+	master *os.File
+	slave  *os.File
+	state  *unix.Termios
+	done   chan struct{}
+	stop   []func()
+}
+
+func openTty() *ttySession {
+	master, slave, err := pty.Open()
+	util.Bail(err)
+
+	return &ttySession{
+		master: master,
+		slave:  slave,
+		done:   make(chan struct{}),
+	}
+}
+
+func (s *ttySession) Files() []*os.File {
+	return []*os.File{s.slave}
+}
+
+// Start wires the caller's stdio to the pty once proc holds the slave end.
+func (s *ttySession) Start(proc *os.Process) {
+	// the master only sees EOF once every slave fd is closed
+	s.slave.Close()
+
+	if pty.IsTerminal(os.Stdin) {
+		// best effort, the caller may resize later
+		pty.InheritSize(os.Stdin, s.master)
+
+		state, err := pty.MakeRaw(os.Stdin)
+		util.Bail(err)
+		s.state = state
+
+		winch := make(chan os.Signal, 1)
+		signal.Notify(winch, syscall.SIGWINCH)
+		go func() {
+			for range winch {
+				pty.InheritSize(os.Stdin, s.master)
+			}
+		}()
+		s.stop = append(s.stop, func() { signal.Stop(winch) })
+	}
+
+	s.stop = append(s.stop, forwardSignals(proc, syscall.SIGQUIT, syscall.SIGUSR1, syscall.SIGUSR2))
+
+	go io.Copy(s.master, os.Stdin)
+	go func() {
+		// returns with EIO when the last slave is closed
+		io.Copy(os.Stdout, s.master)
+		close(s.done)
+	}()
+}
+
+// Wait blocks until the sandbox output is drained and restores the
+// caller's terminal.
+func (s *ttySession) Wait() {
+	<-s.done
+
+	for _, stop := range s.stop {
+		stop()
+	}
+
+	if s.state != nil {
+		pty.Restore(os.Stdin, s.state)
+	}
+
+	s.master.Close()
+}
+
+// output was streamed to the terminal
+func (s *ttySession) Output() string {
+	return ""
+}
+
+func (s *ttySession) Finish(result model.Result) {
+	content, err := json.Marshal(result)
+	util.Bail(err)
+
+	fmt.Fprintln(os.Stderr, string(content))
+}
@@ -1,41 +1,347 @@
 package configs
 
 import (
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"codeberg.org/iklabib/kaleng/capability"
+	"codeberg.org/iklabib/kaleng/landlock"
 	"codeberg.org/iklabib/kaleng/rlimit"
+	"codeberg.org/iklabib/kaleng/units"
 	"github.com/elastic/go-seccomp-bpf"
 )
 
 type Cgroup struct {
-	MaxMemory      string `config:"max_memory" json:"max_memory" yaml:"max_memory"`
-	MaxPids        int    `config:"max_pids" json:"max_pids" yaml:"max_pids"`
-	MaxDepth       int    `config:"max_depth" json:"max_depth" yaml:"max_depth"`
-	MaxDescendants int    `config:"max_descendants" json:"max_descendants" yaml:"max_descendants"`
+	MaxMemory      units.Size `config:"max_memory" json:"max_memory" yaml:"max_memory"`
+	MemoryHigh     units.Size `config:"memory_high" json:"memory_high" yaml:"memory_high"`             // throttle above
+	MemoryLow      units.Size `config:"memory_low" json:"memory_low" yaml:"memory_low"`                // best-effort protection
+	MemorySwapMax  units.Size `config:"memory_swap_max" json:"memory_swap_max" yaml:"memory_swap_max"` // swap disabled if default value
+	MemoryZswapMax units.Size `config:"memory_zswap_max" json:"memory_zswap_max" yaml:"memory_zswap_max"`
+	MaxPids        int        `config:"max_pids" json:"max_pids" yaml:"max_pids"`
+	MaxDepth       int        `config:"max_depth" json:"max_depth" yaml:"max_depth"`
+	MaxDescendants int        `config:"max_descendants" json:"max_descendants" yaml:"max_descendants"`
 	Cpu            `config:"cpu" json:"cpu" yaml:"max_procs"`
+	Io             `config:"io" json:"io" yaml:"io"`
+	Cpuset         `config:"cpuset" json:"cpuset" yaml:"cpuset"`
 }
 
 // no-op if default value
 type Cpu struct {
-	Time   uint `config:"time" yaml:"time" json:"time"`       // cpu.max $MAX
-	Period uint `config:"period" yaml:"period" json:"period"` // cpu.max $PERIOD
-	Weight uint `config:"weight" yaml:"weight" json:"weight"` // cpu.weight
+	Time   units.Microseconds `config:"time" yaml:"time" json:"time"`       // cpu.max $MAX
+	Period units.Microseconds `config:"period" yaml:"period" json:"period"` // cpu.max $PERIOD
+	Weight uint               `config:"weight" yaml:"weight" json:"weight"` // cpu.weight
+}
+
+// no-op if default value
+type Cpuset struct {
+	Cpus string         `config:"cpus" yaml:"cpus" json:"cpus"` // cpuset.cpus
+	Mems string         `config:"mems" yaml:"mems" json:"mems"` // cpuset.mems
+	Pool string         `config:"pool" yaml:"pool" json:"pool"` // each run gets an exclusive cpu from the pool, overrides cpus
+	Wait units.Duration `config:"wait" yaml:"wait" json:"wait"` // longest to wait for a free cpu from the pool, 0 waits forever
+}
+
+// no-op if default value
+type Io struct {
+	Weight uint    `config:"weight" yaml:"weight" json:"weight"` // io.weight
+	Max    []IoMax `config:"max" yaml:"max" json:"max"`          // io.max
+}
+
+// limits of a single device, zero value is no limit
+type IoMax struct {
+	Device string     `config:"device" yaml:"device" json:"device"` // block device or a path on it
+	Rbps   units.Size `config:"rbps" yaml:"rbps" json:"rbps"`       // per second
+	Wbps   units.Size `config:"wbps" yaml:"wbps" json:"wbps"`       // per second
+	Riops  uint64     `config:"riops" yaml:"riops" json:"riops"`
+	Wiops  uint64     `config:"wiops" yaml:"wiops" json:"wiops"`
+}
+
+// Env is a single variable, its value may refer to what is set before it
+// as ${VAR}
+type Env struct {
+	Name  string `config:"name" yaml:"name" json:"name"`
+	Value string `config:"value" yaml:"value" json:"value"`
+}
+
+// Envs are set in order. Entries are NAME=value strings or name and value
+// pairs, a map is set in the order of its names.
+type Envs []Env
+
+// set before passthrough and envs, which override them
+var DefaultEnvs = Envs{
+	{Name: "PATH", Value: "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"},
+	{Name: "HOME", Value: "/"},
+	{Name: "LANG", Value: "C.UTF-8"},
+}
+
+func (e *Envs) Unpack(v interface{}) error {
+	var envs Envs
+	switch v := v.(type) {
+	case map[string]interface{}:
+		names := make([]string, 0, len(v))
+		for name := range v {
+			names = append(names, name)
+		}
+		slices.Sort(names)
+
+		for _, name := range names {
+			envs = append(envs, Env{Name: name, Value: envValue(v[name])})
+		}
+	case []interface{}:
+		for _, entry := range v {
+			env, err := unpackEnv(entry)
+			if err != nil {
+				return err
+			}
+			envs = append(envs, env)
+		}
+	default:
+		return fmt.Errorf("invalid envs %v", v)
+	}
+
+	for _, env := range envs {
+		if err := validEnvName(env.Name); err != nil {
+			return err
+		}
+	}
+
+	*e = envs
+	return nil
+}
+
+func unpackEnv(v interface{}) (Env, error) {
+	switch v := v.(type) {
+	case string:
+		name, value, ok := strings.Cut(v, "=")
+		if !ok {
+			return Env{}, fmt.Errorf("env entry must be NAME=value '%s'", v)
+		}
+		return Env{Name: name, Value: value}, nil
+	case map[string]interface{}:
+		name, ok := v["name"].(string)
+		if !ok {
+			return Env{}, fmt.Errorf("env entry without a name %v", v)
+		}
+		return Env{Name: name, Value: envValue(v["value"])}, nil
+	default:
+		return Env{}, fmt.Errorf("invalid env entry %v", v)
+	}
+}
+
+// numbers and booleans are taken as written
+func envValue(v interface{}) string {
+	if v == nil {
+		return ""
+	}
+
+	return fmt.Sprint(v)
+}
+
+func validEnvName(name string) error {
+	if name == "" || strings.ContainsAny(name, "=\x00") {
+		return fmt.Errorf("invalid env name '%s'", name)
+	}
+
+	return nil
 }
 
 type Bind struct {
-	Source string `config:"source" yaml:"source" json:"source"`
-	Target string `config:"target" yaml:"target" json:"target"`
-	FsType string `config:"fstype" yaml:"fstype" json:"fstype"`
-	Data   string `config:"data" yaml:"data" json:"data"`
+	Source    string `config:"source" yaml:"source" json:"source"`
+	Target    string `config:"target" yaml:"target" json:"target"`
+	FsType    string `config:"fstype" yaml:"fstype" json:"fstype"`
+	Data      string `config:"data" yaml:"data" json:"data"`
+	Readonly  bool   `config:"readonly" yaml:"readonly" json:"readonly"`
+	NoExec    bool   `config:"noexec" yaml:"noexec" json:"noexec"`
+	Recursive bool   `config:"recursive" yaml:"recursive" json:"recursive"` // include submounts of source
+}
+
+type Tmpfs struct {
+	Path   string     `config:"path" yaml:"path" json:"path"`
+	Size   units.Size `config:"size" yaml:"size" json:"size"`       // half of RAM if default value
+	Inodes uint64     `config:"inodes" yaml:"inodes" json:"inodes"` // nr_inodes
+	Mode   string     `config:"mode" yaml:"mode" json:"mode"`       // octal, 1777 if default value
+	NoExec bool       `config:"noexec" yaml:"noexec" json:"noexec"`
+}
+
+// used when tmpfs is not configured
+var DefaultTmpfs = []Tmpfs{
+	{Path: "/tmp", Size: 64 << 20, Mode: "1777"},
+}
+
+type Device struct {
+	Path     string `config:"path" yaml:"path" json:"path"`
+	Mode     string `config:"mode" yaml:"mode" json:"mode"`             // octal, 0666 if default value
+	Optional bool   `config:"optional" yaml:"optional" json:"optional"` // skipped if missing on the host
+}
+
+// used when devices are not configured
+var DefaultDevices = []Device{
+	{Path: "/dev/null", Mode: "0666"},
+	{Path: "/dev/zero", Mode: "0666"},
+	{Path: "/dev/full", Mode: "0666"},
+	{Path: "/dev/random", Mode: "0444"},
+	{Path: "/dev/urandom", Mode: "0444"},
+	{Path: "/dev/tty", Mode: "0666", Optional: true},
+}
+
+// used when shm_size is not configured
+const DefaultShmSize units.Size = 64 << 20
+
+// a deterministic run gets these when hostname and domainname are not
+// configured, the domainname is what a fresh kernel reports
+const (
+	DeterministicHostname   = "kaleng"
+	DeterministicDomainname = "(none)"
+)
+
+// used when home is not configured
+const DefaultHome = "/home/kaleng"
+
+// replaced by a seeded stream in a deterministic run
+var RandomDevices = []string{"/dev/random", "/dev/urandom"}
+
+// Validate checks the path is under /dev and the mode is octal
+func (d Device) Validate() error {
+	if !filepath.IsAbs(d.Path) || !strings.HasPrefix(filepath.Clean(d.Path), "/dev/") {
+		return fmt.Errorf("device path must be under /dev '%s'", d.Path)
+	}
+
+	if _, err := d.FileMode(); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (d Device) FileMode() (uint32, error) {
+	if d.Mode == "" {
+		return 0o666, nil
+	}
+
+	mode, err := strconv.ParseUint(d.Mode, 8, 32)
+	if err != nil || mode > 0o777 {
+		return 0, fmt.Errorf("invalid device mode '%s'", d.Mode)
+	}
+
+	return uint32(mode), nil
+}
+
+// same as OCI runtimes mask by default
+var DefaultMaskedPaths = []string{
+	"/proc/acpi",
+	"/proc/asound",
+	"/proc/interrupts",
+	"/proc/kcore",
+	"/proc/keys",
+	"/proc/latency_stats",
+	"/proc/sched_debug",
+	"/proc/scsi",
+	"/proc/timer_list",
+	"/proc/timer_stats",
+	"/sys/devices/virtual/powercap",
+	"/sys/firmware",
+}
+
+var DefaultReadonlyPaths = []string{
+	"/proc/bus",
+	"/proc/fs",
+	"/proc/irq",
+	"/proc/sys",
+	"/proc/sysrq-trigger",
+}
+
+// Validate checks the path is absolute and the mode is octal
+func (t Tmpfs) Validate() error {
+	if !filepath.IsAbs(t.Path) {
+		return fmt.Errorf("tmpfs path must be absolute '%s'", t.Path)
+	}
+
+	if _, err := t.FileMode(); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (t Tmpfs) FileMode() (uint32, error) {
+	if t.Mode == "" {
+		return 0o1777, nil
+	}
+
+	mode, err := strconv.ParseUint(t.Mode, 8, 32)
+	if err != nil || mode > 0o7777 {
+		return 0, fmt.Errorf("invalid tmpfs mode '%s'", t.Mode)
+	}
+
+	return uint32(mode), nil
+}
+
+// IdMap maps Size ids starting at ContainerID to the host ids starting at
+// HostID, or at HostID into User's /etc/subuid or /etc/subgid range
+// when Subordinate is set
+type IdMap struct {
+	ContainerID int  `config:"container_id" yaml:"container_id" json:"container_id"`
+	HostID      int  `config:"host_id" yaml:"host_id" json:"host_id"`
+	Size        int  `config:"size" yaml:"size" json:"size"`
+	Subordinate bool `config:"subordinate" yaml:"subordinate" json:"subordinate"`
+}
+
+// Validate rejects negative ids and empty ranges
+func (m IdMap) Validate() error {
+	if m.ContainerID < 0 || m.HostID < 0 || m.Size <= 0 {
+		return fmt.Errorf("invalid id mapping %d:%d:%d", m.ContainerID, m.HostID, m.Size)
+	}
+
+	return nil
+}
+
+// TimeOffsets are what the clocks of the TIME namespace read when the
+// sandbox starts, the offsets from the host clocks follow from them
+type TimeOffsets struct {
+	Monotonic units.Duration `config:"monotonic" yaml:"monotonic" json:"monotonic"`
+	Boottime  units.Duration `config:"boottime" yaml:"boottime" json:"boottime"`
 }
 
 type KalengConfig struct {
 	Cgroup     `config:"cgroup" json:"cgroup"`
-	Envs       map[string]string `config:"envs" yaml:"envs" json:"envs"`
-	Namespaces []string          `config:"namespaces" yaml:"namespaces"  json:"namespaces"`
-	Rlimits    []rlimit.Rlimit   `config:"rlimits" yaml:"rlimits" json:"rlimits"`
-	Seccomp    seccomp.Policy    `config:"seccomp" yaml:"seccomp" json:"seccomp"`
-	User       string            `config:"user" yaml:"user" json:"user"`
-	Group      string            `config:"group" yaml:"group" json:"group"`
-	TimeLimit  int               `config:"time_limit" yaml:"time_limit" json:"time_limit"` // s
-	Files      []string          `config:"files" yaml:"files" json:"files"`                // fd:rwxc:/path
-	Binds      []Bind            `config:"binds" yaml:"binds" json:"binds"`
+	Envs       Envs            `config:"envs" yaml:"envs" json:"envs"`
+	Namespaces []string        `config:"namespaces" yaml:"namespaces"  json:"namespaces"`
+	Rlimits    []rlimit.Rlimit `config:"rlimits" yaml:"rlimits" json:"rlimits"`
+	Seccomp    seccomp.Policy  `config:"seccomp" yaml:"seccomp" json:"seccomp"`
+	User       string          `config:"user" yaml:"user" json:"user"`
+	Group      string          `config:"group" yaml:"group" json:"group"`
+	// without a USER namespace, kaleng has to run as root and drops to
+	// User and Group right before exec
+	Rootful bool `config:"rootful" yaml:"rootful" json:"rootful"`
+	// only the caller's id is mapped to User and Group if not configured
+	UidMappings []IdMap         `config:"uid_mappings" yaml:"uid_mappings" json:"uid_mappings"`
+	GidMappings []IdMap         `config:"gid_mappings" yaml:"gid_mappings" json:"gid_mappings"`
+	Hostname    string          `config:"hostname" yaml:"hostname" json:"hostname"`             // needs UTS
+	Domainname  string          `config:"domainname" yaml:"domainname" json:"domainname"`       // needs UTS
+	TimeOffsets *TimeOffsets    `config:"time_offsets" yaml:"time_offsets" json:"time_offsets"` // needs TIME, host clocks if not configured
+	TimeLimit   units.Duration  `config:"time_limit" yaml:"time_limit" json:"time_limit"`       // wall clock from setup start, includes entering the root and applying restrictions
+	GracePeriod units.Duration  `config:"grace_period" yaml:"grace_period" json:"grace_period"` // between SIGTERM and SIGKILL at the time limit
+	Files       []string        `config:"files" yaml:"files" json:"files"`                      // fd:rwxc:/path
+	Landlock    landlock.Policy `config:"landlock" yaml:"landlock" json:"landlock"`
+	// kept for the program, everything is dropped if not configured
+	Capabilities capability.Set `config:"capabilities" yaml:"capabilities" json:"capabilities"`
+	Binds        []Bind         `config:"binds" yaml:"binds" json:"binds"`
+	Tmpfs        []Tmpfs        `config:"tmpfs" yaml:"tmpfs" json:"tmpfs"`
+	Devices      []Device       `config:"devices" yaml:"devices" json:"devices"`
+	ShmSize      units.Size     `config:"shm_size" yaml:"shm_size" json:"shm_size"`
+	// inside the fresh /proc and /sys, defaults apply if not configured
+	MaskedPaths   []string `config:"masked_paths" yaml:"masked_paths" json:"masked_paths"`
+	ReadonlyPaths []string `config:"readonly_paths" yaml:"readonly_paths" json:"readonly_paths"`
+	// pins what varies between runs, the random devices replay Seed
+	Deterministic bool   `config:"deterministic" yaml:"deterministic" json:"deterministic"`
+	Seed          uint64 `config:"seed" yaml:"seed" json:"seed"` // picked at random if not configured
+	// host variables kept by name, ignored by a deterministic run
+	EnvPassthrough []string `config:"env_passthrough" yaml:"env_passthrough" json:"env_passthrough"`
+	// created for the run and owned by User, DefaultHome if not configured.
+	// Under landlock only what is created is writable, an existing Workdir
+	// must be writable by the policy.
+	Home    string `config:"home" yaml:"home" json:"home"`
+	Workdir string `config:"workdir" yaml:"workdir" json:"workdir"` // created if missing, Home if not configured
 }
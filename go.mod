@@ -6,15 +6,13 @@ require (
 	github.com/alecthomas/kong v1.6.0
 	github.com/elastic/go-seccomp-bpf v1.5.0
 	github.com/elastic/go-ucfg v0.8.8
-	github.com/shoenig/go-landlock v1.2.2
+	golang.org/x/sys v0.28.0
+	kernel.org/pub/linux/libs/security/libcap/psx v1.2.73
 )
 
 require (
-	github.com/hashicorp/go-set/v2 v2.1.0 // indirect
 	github.com/kr/text v0.2.0 // indirect
 	github.com/stretchr/testify v1.9.0 // indirect
 	golang.org/x/net v0.32.0 // indirect
-	golang.org/x/sys v0.28.0 // indirect
 	gopkg.in/yaml.v2 v2.4.0 // indirect
-	kernel.org/pub/linux/libs/security/libcap/psx v1.2.73 // indirect
 )
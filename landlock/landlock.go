@@ -0,0 +1,369 @@
+package landlock
+
+import (
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strings"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+	"kernel.org/pub/linux/libs/security/libcap/psx"
+)
+
+const (
+	Mandatory  = "mandatory"
+	BestEffort = "best_effort" // drop what the kernel lacks with a warning
+)
+
+// not in x/sys/unix yet
+const ruleNetPort = 2
+
+// an access right and the ABI version introducing it
+type right struct {
+	bit uint64
+	abi int
+}
+
+var fsRights = map[string]right{
+	"execute":     {unix.LANDLOCK_ACCESS_FS_EXECUTE, 1},
+	"write_file":  {unix.LANDLOCK_ACCESS_FS_WRITE_FILE, 1},
+	"read_file":   {unix.LANDLOCK_ACCESS_FS_READ_FILE, 1},
+	"read_dir":    {unix.LANDLOCK_ACCESS_FS_READ_DIR, 1},
+	"remove_dir":  {unix.LANDLOCK_ACCESS_FS_REMOVE_DIR, 1},
+	"remove_file": {unix.LANDLOCK_ACCESS_FS_REMOVE_FILE, 1},
+	"make_char":   {unix.LANDLOCK_ACCESS_FS_MAKE_CHAR, 1},
+	"make_dir":    {unix.LANDLOCK_ACCESS_FS_MAKE_DIR, 1},
+	"make_reg":    {unix.LANDLOCK_ACCESS_FS_MAKE_REG, 1},
+	"make_sock":   {unix.LANDLOCK_ACCESS_FS_MAKE_SOCK, 1},
+	"make_fifo":   {unix.LANDLOCK_ACCESS_FS_MAKE_FIFO, 1},
+	"make_block":  {unix.LANDLOCK_ACCESS_FS_MAKE_BLOCK, 1},
+	"make_sym":    {unix.LANDLOCK_ACCESS_FS_MAKE_SYM, 1},
+	"refer":       {unix.LANDLOCK_ACCESS_FS_REFER, 2},
+	"truncate":    {unix.LANDLOCK_ACCESS_FS_TRUNCATE, 3},
+	"ioctl_dev":   {unix.LANDLOCK_ACCESS_FS_IOCTL_DEV, 5},
+}
+
+var netRights = map[string]right{
+	"bind_tcp":    {unix.LANDLOCK_ACCESS_NET_BIND_TCP, 4},
+	"connect_tcp": {unix.LANDLOCK_ACCESS_NET_CONNECT_TCP, 4},
+}
+
+// the only rights the kernel accepts on a path that is not a directory
+var fileRights = []string{"execute", "write_file", "read_file", "truncate", "ioctl_dev"}
+
+// PathRule grants access beneath Path, or to Path itself if it is a file
+type PathRule struct {
+	Path     string   `config:"path" yaml:"path" json:"path"`
+	Access   []string `config:"access" yaml:"access" json:"access"`       // e.g. read_file, truncate, ioctl_dev
+	Optional bool     `config:"optional" yaml:"optional" json:"optional"` // skipped if missing
+}
+
+// PortRule grants TCP access to a port, requires ABI v4
+type PortRule struct {
+	Port   uint16   `config:"port" yaml:"port" json:"port"`
+	Access []string `config:"access" yaml:"access" json:"access"` // bind_tcp, connect_tcp
+}
+
+type Policy struct {
+	Mode  string     `config:"mode" yaml:"mode" json:"mode"` // mandatory if default value
+	Paths []PathRule `config:"paths" yaml:"paths" json:"paths"`
+	Ports []PortRule `config:"ports" yaml:"ports" json:"ports"`
+}
+
+// Grants reports whether the rules on path and its parents together allow
+// every right in access, landlock adds up the rights of a hierarchy
+func (p Policy) Grants(path string, access ...string) bool {
+	path = filepath.Clean(path)
+	var granted []string
+	for _, rule := range p.Paths {
+		base := filepath.Clean(rule.Path)
+		if path == base || strings.HasPrefix(path, strings.TrimSuffix(base, "/")+"/") {
+			granted = append(granted, rule.Access...)
+		}
+	}
+
+	for _, name := range access {
+		if !slices.Contains(granted, name) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Validate checks the mode, that paths are absolute and that every rule
+// grants known access rights
+func (p Policy) Validate() error {
+	if p.Mode != "" && p.Mode != Mandatory && p.Mode != BestEffort {
+		return fmt.Errorf("unknown landlock mode '%s'", p.Mode)
+	}
+
+	for _, rule := range p.Paths {
+		if !filepath.IsAbs(rule.Path) {
+			return fmt.Errorf("landlock path must be absolute '%s'", rule.Path)
+		}
+
+		if err := validRights(rule.Access, fsRights); err != nil {
+			return err
+		}
+	}
+
+	for _, rule := range p.Ports {
+		if err := validRights(rule.Access, netRights); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func validRights(access []string, rights map[string]right) error {
+	if len(access) == 0 {
+		return fmt.Errorf("landlock rule without access rights")
+	}
+
+	for _, name := range access {
+		if _, ok := rights[name]; !ok {
+			return fmt.Errorf("unknown landlock access right '%s'", name)
+		}
+	}
+
+	return nil
+}
+
+// ParseFile converts the legacy "kind:rwxc:/path" form, kind being d or f
+func ParseFile(s string) (PathRule, error) {
+	tokens := strings.SplitN(strings.TrimSpace(s), ":", 3)
+	if len(tokens) != 3 || tokens[2] == "" || (tokens[0] != "d" && tokens[0] != "f") || tokens[1] == "" {
+		return PathRule{}, fmt.Errorf("improper landlock file '%s'", s)
+	}
+
+	dir := tokens[0] == "d"
+	rule := PathRule{Path: tokens[2]}
+	for _, c := range tokens[1] {
+		switch c {
+		case 'r':
+			rule.Access = append(rule.Access, "read_file")
+			if dir {
+				rule.Access = append(rule.Access, "read_dir")
+			}
+		case 'w':
+			rule.Access = append(rule.Access, "write_file", "truncate")
+		case 'x':
+			rule.Access = append(rule.Access, "execute")
+		case 'c':
+			if dir {
+				rule.Access = append(rule.Access, "make_reg", "make_sock", "make_fifo", "make_block",
+					"make_sym", "make_dir", "remove_file", "remove_dir", "refer")
+			}
+		default:
+			return PathRule{}, fmt.Errorf("improper landlock mode '%s'", tokens[1])
+		}
+	}
+
+	return rule, nil
+}
+
+// Version is the landlock ABI of the running kernel, 0 if unavailable
+func Version() int {
+	v, _, errno := unix.Syscall(unix.SYS_LANDLOCK_CREATE_RULESET, 0, 0, unix.LANDLOCK_CREATE_RULESET_VERSION)
+	if errno != 0 {
+		return 0
+	}
+
+	return int(v)
+}
+
+// Enforce restricts every thread of the process and what it executes. In
+// best effort mode anything the kernel lacks is dropped and reported in
+// the returned warnings.
+func (p Policy) Enforce() ([]string, error) {
+	l := locker{abi: Version(), bestEffort: p.Mode == BestEffort}
+	if l.abi == 0 && !l.bestEffort {
+		return nil, fmt.Errorf("landlock is not available")
+	}
+
+	// no-op
+	if len(p.Paths) == 0 && len(p.Ports) == 0 {
+		return nil, nil
+	}
+
+	if l.abi == 0 {
+		return []string{"landlock is not available, running without it"}, nil
+	}
+
+	var attr unix.LandlockRulesetAttr
+	if len(p.Paths) > 0 {
+		handled, err := l.handledFs(p.Paths)
+		if err != nil {
+			return nil, err
+		}
+		attr.Access_fs = handled
+	}
+
+	if len(p.Ports) > 0 {
+		if l.abi < 4 {
+			if err := l.degrade("tcp port rules need landlock ABI v4, kernel has v%d", l.abi); err != nil {
+				return nil, err
+			}
+		} else {
+			attr.Access_net = unix.LANDLOCK_ACCESS_NET_BIND_TCP | unix.LANDLOCK_ACCESS_NET_CONNECT_TCP
+		}
+	}
+
+	// every port rule was dropped
+	if attr.Access_fs == 0 && attr.Access_net == 0 {
+		return l.warnings, nil
+	}
+
+	fd, _, errno := unix.Syscall(unix.SYS_LANDLOCK_CREATE_RULESET, uintptr(unsafe.Pointer(&attr)), unsafe.Sizeof(attr), 0)
+	if errno != 0 {
+		return nil, fmt.Errorf("failed to create landlock ruleset %v", errno)
+	}
+	defer unix.Close(int(fd))
+
+	for _, rule := range p.Paths {
+		if err := l.addPath(int(fd), rule); err != nil {
+			return nil, err
+		}
+	}
+
+	if attr.Access_net != 0 {
+		for _, rule := range p.Ports {
+			if err := l.addPort(int(fd), rule); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// psx applies the calls to every OS thread, with or without cgo
+	if _, _, errno := psx.Syscall6(unix.SYS_PRCTL, unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0, 0); errno != 0 {
+		return nil, fmt.Errorf("failed to set no_new_privs %v", errno)
+	}
+
+	if _, _, errno := psx.Syscall3(unix.SYS_LANDLOCK_RESTRICT_SELF, fd, 0, 0); errno != 0 {
+		return nil, fmt.Errorf("failed to enforce landlock %v", errno)
+	}
+
+	return l.warnings, nil
+}
+
+type locker struct {
+	abi        int
+	bestEffort bool
+	warnings   []string
+}
+
+// degrade records a warning in best effort mode and fails otherwise
+func (l *locker) degrade(format string, args ...any) error {
+	msg := fmt.Sprintf(format, args...)
+	if !l.bestEffort {
+		return fmt.Errorf("%s", msg)
+	}
+
+	l.warnings = append(l.warnings, msg)
+	return nil
+}
+
+// everything the kernel supports is denied unless granted by a rule.
+// ioctl_dev is only handled when asked for, device ioctls stay open
+// otherwise as they did before ABI v5.
+func (l *locker) handledFs(rules []PathRule) (uint64, error) {
+	var handled uint64
+	for name, r := range fsRights {
+		if name == "ioctl_dev" && !slices.ContainsFunc(rules, func(rule PathRule) bool {
+			return slices.Contains(rule.Access, name)
+		}) {
+			continue
+		}
+
+		if r.abi <= l.abi {
+			handled |= r.bit
+			continue
+		}
+
+		if name == "ioctl_dev" {
+			if err := l.degrade("device ioctl rules need landlock ABI v%d, kernel has v%d", r.abi, l.abi); err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	return handled, nil
+}
+
+// rights the kernel does not know are not handled either, they are allowed
+// with or without the grant
+func (l *locker) access(names []string, rights map[string]right) uint64 {
+	var access uint64
+	for _, name := range names {
+		if r := rights[name]; r.abi <= l.abi {
+			access |= r.bit
+		}
+	}
+
+	return access
+}
+
+func (l *locker) addPath(ruleset int, rule PathRule) error {
+	fd, err := unix.Open(rule.Path, unix.O_PATH|unix.O_CLOEXEC, 0)
+	if err != nil {
+		if rule.Optional && err == unix.ENOENT {
+			return nil
+		}
+
+		return fmt.Errorf("landlock path %s %v", rule.Path, err)
+	}
+	defer unix.Close(fd)
+
+	var stat unix.Stat_t
+	if err := unix.Fstat(fd, &stat); err != nil {
+		return fmt.Errorf("landlock path %s %v", rule.Path, err)
+	}
+
+	if stat.Mode&unix.S_IFMT != unix.S_IFDIR {
+		for _, name := range rule.Access {
+			if !slices.Contains(fileRights, name) {
+				return fmt.Errorf("landlock path %s: %s only applies to directories", rule.Path, name)
+			}
+		}
+	}
+
+	access := l.access(rule.Access, fsRights)
+
+	// nothing left to grant
+	if access == 0 {
+		return nil
+	}
+
+	attr := unix.LandlockPathBeneathAttr{
+		Allowed_access: access,
+		Parent_fd:      int32(fd),
+	}
+
+	_, _, errno := unix.Syscall6(unix.SYS_LANDLOCK_ADD_RULE, uintptr(ruleset), unix.LANDLOCK_RULE_PATH_BENEATH,
+		uintptr(unsafe.Pointer(&attr)), 0, 0, 0)
+	if errno != 0 {
+		return fmt.Errorf("landlock path %s %v", rule.Path, errno)
+	}
+
+	return nil
+}
+
+func (l *locker) addPort(ruleset int, rule PortRule) error {
+	access := l.access(rule.Access, netRights)
+
+	attr := struct {
+		allowedAccess uint64
+		port          uint64
+	}{access, uint64(rule.Port)}
+
+	_, _, errno := unix.Syscall6(unix.SYS_LANDLOCK_ADD_RULE, uintptr(ruleset), ruleNetPort,
+		uintptr(unsafe.Pointer(&attr)), 0, 0, 0)
+	if errno != 0 {
+		return fmt.Errorf("landlock port %d %v", rule.Port, errno)
+	}
+
+	return nil
+}
@@ -1,21 +1,48 @@
 package model
 
 import (
-	"os"
+	"syscall"
 	"time"
 )
 
 type Metrics struct {
-	Signal   os.Signal     `json:"signal"`
-	ExitCode int           `json:"exit_code"`
-	SysTime  time.Duration `json:"sys_time"`
-	UserTime time.Duration `json:"time"`
-	WallTime time.Duration `json:"wall_time"`
-	Memory   int64         `json:"memory"`
+	Signal   syscall.Signal `json:"signal"` // 0 if the program exited
+	ExitCode int            `json:"exit_code"`
+	SysTime  time.Duration  `json:"sys_time"`
+	UserTime time.Duration  `json:"time"`
+	WallTime time.Duration  `json:"wall_time"`
+	Memory   int64          `json:"memory"`
 }
 
 type Result struct {
-  Output string   `json:"output"` // stdout + stderr
-  Message []string `json:"message"`
-  Metric  Metrics  `json:"metric"`
+	Output  string   `json:"output"` // stdout + stderr
+	Message []string `json:"message"`
+	Metric  Metrics  `json:"metric"`
+	Seed    uint64   `json:"seed,omitempty"` // of a deterministic run
+}
+
+const (
+	EventStarted   = "started"
+	EventStdout    = "stdout"
+	EventStderr    = "stderr"
+	EventSample    = "sample"
+	EventViolation = "violation"
+	EventExited    = "exited"
+)
+
+// resource usage of the whole run, read from its cgroup
+type Sample struct {
+	Memory  int64         `json:"memory"` // bytes
+	Pids    int           `json:"pids"`
+	CpuTime time.Duration `json:"cpu_time"`
+}
+
+// a line of the --stream output
+type Event struct {
+	Type    string        `json:"type"`
+	Elapsed time.Duration `json:"elapsed"`
+	Data    string        `json:"data,omitempty"`    // stdout, stderr
+	Sample  *Sample       `json:"sample,omitempty"`  // sample
+	Message string        `json:"message,omitempty"` // violation
+	Result  *Result       `json:"result,omitempty"`  // exited
 }
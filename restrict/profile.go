@@ -0,0 +1,171 @@
+package restrict
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"codeberg.org/iklabib/kaleng/schema"
+	"github.com/elastic/go-ucfg"
+	"github.com/elastic/go-ucfg/parse"
+	"github.com/elastic/go-ucfg/yaml"
+)
+
+// keys only the loader knows, they are not part of KalengConfig
+const (
+	extendsKey = "extends"
+	appendKey  = "append"
+)
+
+// a profile directs how it is merged onto the one it extends
+type directives struct {
+	Extends string   `config:"extends"` // relative to the extending file
+	Append  []string `config:"append"`  // lists appended to the base, e.g. binds or landlock.paths
+}
+
+// ReadConfig reads the config at path merged onto the profiles it extends,
+// then applies overrides in the form KEY=VALUE. Maps are merged deeply,
+// lists replace the base unless they are listed in append, an empty list
+// clears it. The result is what Config takes.
+func ReadConfig(path string, overrides []string) ([]byte, error) {
+	cfg, err := readProfile(path, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, override := range overrides {
+		key, value, ok := strings.Cut(override, "=")
+		if !ok || key == "" {
+			return nil, fmt.Errorf("override must be KEY=VALUE '%s'", override)
+		}
+
+		// numbers, booleans and [lists] are taken as written unless the
+		// field is a string, "quoted" values are always strings
+		var parsed interface{} = value
+		quoted := len(value) >= 2 && strings.ContainsRune(`"'`, rune(value[0])) && value[len(value)-1] == value[0]
+		if field := schema.Config().Field(key); quoted || field == nil || field.Type != "string" {
+			if parsed, err = parse.Value(value); err != nil {
+				return nil, fmt.Errorf("override %s: %s", key, err.Error())
+			}
+
+			// parsed as null
+			if strings.ReplaceAll(value, " ", "") == "[]" {
+				parsed = []interface{}{}
+			}
+		}
+
+		// an indexed key like binds.0.readonly merges into its element
+		opts := []ucfg.Option{ucfg.PathSep(".")}
+		if list, ok := parsed.([]interface{}); ok {
+			opts = append(opts, ucfg.FieldReplaceValues(key))
+			// merging nothing would leave the list as is
+			if len(list) == 0 {
+				if _, err := cfg.Remove(key, -1, ucfg.PathSep(".")); err != nil {
+					return nil, fmt.Errorf("override %s: %s", key, err.Error())
+				}
+			}
+		}
+
+		if err := cfg.Merge(map[string]interface{}{key: parsed}, opts...); err != nil {
+			return nil, fmt.Errorf("override %s: %s", key, err.Error())
+		}
+	}
+
+	var merged map[string]interface{}
+	if err := cfg.Unpack(&merged); err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(merged)
+}
+
+// readProfile loads path onto the profile it extends, seen holds the files
+// extending it to catch cycles
+func readProfile(path string, seen []string) (*ucfg.Config, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if slices.Contains(seen, path) {
+		return nil, fmt.Errorf("%s extends itself", path)
+	}
+
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg, err := yaml.NewConfig(buf, ucfg.PathSep("."))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err.Error())
+	}
+
+	var profile directives
+	if err := cfg.Unpack(&profile); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err.Error())
+	}
+
+	for _, key := range []string{extendsKey, appendKey} {
+		if _, err := cfg.Remove(key, -1); err != nil {
+			return nil, fmt.Errorf("%s: %s", path, err.Error())
+		}
+	}
+
+	if profile.Extends == "" {
+		return cfg, nil
+	}
+
+	base := profile.Extends
+	if !filepath.IsAbs(base) {
+		base = filepath.Join(filepath.Dir(path), base)
+	}
+
+	merged, err := readProfile(base, append(seen, path))
+	if err != nil {
+		return nil, err
+	}
+
+	// merging an empty list would leave the base list as is
+	var fields map[string]interface{}
+	if err := cfg.Unpack(&fields); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err.Error())
+	}
+
+	for _, key := range emptyLists(fields, "") {
+		if slices.Contains(profile.Append, key) {
+			continue
+		}
+
+		if _, err := merged.Remove(key, -1, ucfg.PathSep(".")); err != nil {
+			return nil, fmt.Errorf("%s: %s", path, err.Error())
+		}
+	}
+
+	opts := []ucfg.Option{ucfg.PathSep("."), ucfg.ReplaceArrValues, ucfg.FieldAppendValues(profile.Append...)}
+	if err := merged.Merge(cfg, opts...); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err.Error())
+	}
+
+	return merged, nil
+}
+
+// dotted paths of the empty lists in fields, lists are not descended into
+func emptyLists(fields map[string]interface{}, prefix string) []string {
+	var paths []string
+	for key, v := range fields {
+		switch v := v.(type) {
+		case []interface{}:
+			if len(v) == 0 {
+				paths = append(paths, prefix+key)
+			}
+		case map[string]interface{}:
+			paths = append(paths, emptyLists(v, prefix+key+".")...)
+		}
+	}
+
+	return paths
+}
@@ -5,27 +5,206 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
 	"syscall"
+	"time"
 
+	"codeberg.org/iklabib/kaleng/capability"
 	"codeberg.org/iklabib/kaleng/cgroup"
 	"codeberg.org/iklabib/kaleng/configs"
+	"codeberg.org/iklabib/kaleng/landlock"
 	"codeberg.org/iklabib/kaleng/rlimit"
+	"codeberg.org/iklabib/kaleng/schema"
 	"codeberg.org/iklabib/kaleng/util"
 	"github.com/elastic/go-seccomp-bpf"
 	"github.com/elastic/go-ucfg/yaml"
-	"github.com/shoenig/go-landlock"
+	"golang.org/x/sys/unix"
+	"kernel.org/pub/linux/libs/security/libcap/psx"
 )
 
-func Setup() configs.KalengConfig {
+// Setup applies the restrictions to the calling process, uid and gid are
+// only used by rootful runs. cwd overrides the configured workdir.
+func Setup(uid, gid int, cwd string) configs.KalengConfig {
 	config := LoadConfig()
-	SetEnvs(config.Envs)
+	IsolateProc(config)
+	if !config.Rootful {
+		// setup already switched to them
+		uid, gid = os.Getuid(), os.Getgid()
+	}
+	home, workdir, created := MakeDirs(config, cwd, uid, gid)
+	SetEnvs(config.Envs, envPassthrough(config), home)
 	SetRlimits(config.Rlimits)
-	EnforceLandlock(config.Files)
+	EnforceLandlock(config.Landlock, config.Files, workdir, created)
+	if config.Rootful {
+		// capabilities are set once we are the user
+		util.Bail(capability.KeepOnSetuid())
+		PrivelegeDrop(uid, gid)
+	}
+	SetCapabilities(config.Capabilities)
+	if config.Deterministic {
+		DisableASLR()
+		// runtimes fall back to the seeded random devices
+		EnforceSeccomp(getrandomPolicy)
+	}
 	EnforceSeccomp(config.Seccomp)
 
 	return config
 }
 
+// a deterministic run does not depend on the host environment
+func envPassthrough(config configs.KalengConfig) []string {
+	if config.Deterministic && len(config.EnvPassthrough) > 0 {
+		util.Warn("env_passthrough is ignored by a deterministic run")
+		return nil
+	}
+
+	return config.EnvPassthrough
+}
+
+// IsolateProc replaces the host /proc with one of our PID namespace and
+// masks the paths that leak host details. Without a mount namespace the
+// mounts would land on the host, so it is a no-op. Without a PID namespace
+// the kernel refuses a new procfs, the masks still apply to the old one.
+func IsolateProc(config configs.KalengConfig) {
+	if !slices.Contains(config.Namespaces, "MNT") {
+		return
+	}
+
+	if slices.Contains(config.Namespaces, "PID") {
+		util.MountFreshProc()
+	}
+
+	masked := config.MaskedPaths
+	if len(masked) == 0 {
+		masked = configs.DefaultMaskedPaths
+	}
+
+	readonly := config.ReadonlyPaths
+	if len(readonly) == 0 {
+		readonly = configs.DefaultReadonlyPaths
+	}
+
+	for _, path := range readonly {
+		util.ReadonlyPath(path)
+	}
+
+	for _, path := range masked {
+		util.MaskPath(path)
+	}
+}
+
+// MakeDirs creates the home of the program and its working directory if
+// missing, both owned by uid and gid, then changes into the working
+// directory. It returns the home, the working directory and which of them
+// it created.
+func MakeDirs(config configs.KalengConfig, cwd string, uid, gid int) (string, string, []string) {
+	home := config.Home
+	if home == "" {
+		home = configs.DefaultHome
+	}
+
+	workdir := cwd
+	if workdir == "" {
+		workdir = config.Workdir
+	}
+	if workdir == "" {
+		workdir = home
+	}
+
+	if !filepath.IsAbs(home) || !filepath.IsAbs(workdir) {
+		util.MessageBail("home and workdir must be absolute")
+	}
+
+	var created []string
+	for _, dir := range []string{home, workdir} {
+		if _, err := os.Stat(dir); err == nil {
+			continue
+		}
+
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			util.Bail(fmt.Errorf("failed to create %s %s", dir, err.Error()))
+		}
+
+		if err := os.Chown(dir, uid, gid); err != nil {
+			util.Bail(fmt.Errorf("failed to chown %s %s", dir, err.Error()))
+		}
+
+		created = append(created, dir)
+	}
+
+	if err := os.Chdir(workdir); err != nil {
+		util.Bail(fmt.Errorf("failed to change dir to %s %s", workdir, err.Error()))
+	}
+
+	return home, workdir, created
+}
+
+// SetHostname names the UTS namespace of the calling process
+func SetHostname(config configs.KalengConfig) {
+	if config.Hostname == "" && config.Domainname == "" {
+		return
+	}
+
+	if !slices.Contains(config.Namespaces, "UTS") {
+		util.MessageBail("hostname and domainname need the UTS namespace")
+	}
+
+	if config.Hostname != "" {
+		util.Bail(unix.Sethostname([]byte(config.Hostname)))
+	}
+
+	if config.Domainname != "" {
+		util.Bail(unix.Setdomainname([]byte(config.Domainname)))
+	}
+}
+
+// UnshareTime puts the children of the calling thread in a new TIME
+// namespace, the thread has to stay locked until they are started. The
+// offsets belong to the main thread so it has to be the caller.
+func UnshareTime(offsets *configs.TimeOffsets) {
+	if err := unix.Unshare(unix.CLONE_NEWTIME); err != nil {
+		util.Bail(fmt.Errorf("failed to unshare time namespace %s", err.Error()))
+	}
+
+	// no-op
+	if offsets == nil {
+		return
+	}
+
+	clocks := []struct {
+		name  string
+		id    int32
+		value time.Duration
+	}{
+		{"monotonic", unix.CLOCK_MONOTONIC, time.Duration(offsets.Monotonic)},
+		{"boottime", unix.CLOCK_BOOTTIME, time.Duration(offsets.Boottime)},
+	}
+
+	var content strings.Builder
+	for _, clock := range clocks {
+		var now unix.Timespec
+		util.Bail(unix.ClockGettime(clock.id, &now))
+
+		// the clock moves on until the write, it never reads below value
+		offset := clock.value - time.Duration(now.Nano())
+		sec, nsec := offset/time.Second, offset%time.Second
+		if nsec < 0 {
+			sec, nsec = sec-1, nsec+time.Second
+		}
+
+		fmt.Fprintf(&content, "%s %d %d\n", clock.name, sec, nsec)
+	}
+
+	// offsets can only be written before any process enters
+	err := os.WriteFile("/proc/self/timens_offsets", []byte(content.String()), 0)
+	if err != nil {
+		util.Bail(fmt.Errorf("failed to set time offsets %s", err.Error()))
+	}
+}
+
 func Config(buf []byte) (configs.KalengConfig, error) {
 	var config configs.KalengConfig
 	cfg, err := yaml.NewConfig(buf)
@@ -33,13 +212,52 @@ func Config(buf []byte) (configs.KalengConfig, error) {
 		return config, err
 	}
 
+	var raw map[string]interface{}
+	if err := cfg.Unpack(&raw); err != nil {
+		return config, err
+	}
+
+	if err := schema.Config().Validate(raw); err != nil {
+		return config, err
+	}
+
 	if err := cfg.Unpack(&config); err != nil {
 		return config, err
 	}
 
+	if config.Deterministic {
+		config = deterministic(config)
+	}
+
 	return config, nil
 }
 
+// deterministic fills in what a deterministic run pins: fresh PID, UTS and
+// TIME namespaces, the hostname and the clocks. The realtime clock can not
+// be pinned by a TIME namespace.
+func deterministic(config configs.KalengConfig) configs.KalengConfig {
+	config.Namespaces = slices.Clone(config.Namespaces)
+	for _, ns := range []string{"PID", "UTS", "TIME"} {
+		if !slices.Contains(config.Namespaces, ns) {
+			config.Namespaces = append(config.Namespaces, ns)
+		}
+	}
+
+	if config.Hostname == "" {
+		config.Hostname = configs.DeterministicHostname
+	}
+
+	if config.Domainname == "" {
+		config.Domainname = configs.DeterministicDomainname
+	}
+
+	if config.TimeOffsets == nil {
+		config.TimeOffsets = &configs.TimeOffsets{}
+	}
+
+	return config
+}
+
 func LoadConfig() configs.KalengConfig {
 	buf, err := io.ReadAll(os.Stdin)
 	util.Bail(err)
@@ -50,14 +268,40 @@ func LoadConfig() configs.KalengConfig {
 	return config
 }
 
-func SetEnvs(envs map[string]string) {
+var envReference = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// SetEnvs replaces the environment with the defaults, HOME, the host
+// variables in passthrough and envs, in that order. Later ones override
+// earlier ones in place so environ keeps the order they were first set in.
+func SetEnvs(envs configs.Envs, passthrough []string, home string) {
+	host := map[string]string{}
+	for _, name := range passthrough {
+		if value, ok := os.LookupEnv(name); ok {
+			host[name] = value
+		}
+	}
+
 	os.Clearenv()
 
-	for k, v := range envs {
-		if err := os.Setenv(k, v); err != nil {
-			util.Bail(err)
+	for _, env := range configs.DefaultEnvs {
+		util.Bail(os.Setenv(env.Name, env.Value))
+	}
+	util.Bail(os.Setenv("HOME", home))
+
+	for _, name := range passthrough {
+		if value, ok := host[name]; ok {
+			util.Bail(os.Setenv(name, value))
 		}
 	}
+
+	// unset variables expand to nothing
+	for _, env := range envs {
+		value := envReference.ReplaceAllStringFunc(env.Value, func(ref string) string {
+			return os.Getenv(envReference.FindStringSubmatch(ref)[1])
+		})
+
+		util.Bail(os.Setenv(env.Name, value))
+	}
 }
 
 func EnforceSeccomp(policy seccomp.Policy) {
@@ -74,6 +318,36 @@ func EnforceSeccomp(policy seccomp.Policy) {
 	util.Bail(seccomp.LoadFilter(filter))
 }
 
+var getrandomPolicy = seccomp.Policy{
+	DefaultAction: seccomp.ActionAllow,
+	Syscalls: []seccomp.SyscallGroup{
+		{
+			Action: seccomp.ActionErrno | seccomp.Action(unix.ENOSYS),
+			Names:  []string{"getrandom"},
+		},
+	},
+}
+
+// from linux/personality.h
+const (
+	addrNoRandomize = 0x0040000
+	personaQuery    = 0xffffffff
+)
+
+// DisableASLR sets ADDR_NO_RANDOMIZE on every thread, the program inherits
+// it from whichever one execs it
+func DisableASLR() {
+	persona, _, errno := unix.Syscall(unix.SYS_PERSONALITY, personaQuery, 0, 0)
+	if errno != 0 {
+		util.Bail(fmt.Errorf("failed to get personality %s", errno.Error()))
+	}
+
+	_, _, errno = psx.Syscall3(unix.SYS_PERSONALITY, persona|addrNoRandomize, 0, 0)
+	if errno != 0 {
+		util.Bail(fmt.Errorf("failed to disable ASLR %s", errno.Error()))
+	}
+}
+
 func PrivelegeDrop(uid, gid int) {
 	if uid == 0 {
 		util.MessageBail("uid 0 is not allowed")
@@ -84,7 +358,7 @@ func PrivelegeDrop(uid, gid int) {
 	}
 
 	if err := syscall.Setresgid(gid, gid, gid); err != nil {
-		util.MessageBail("failed to set uid")
+		util.MessageBail("failed to set gid")
 	}
 
 	if err := syscall.Setresuid(uid, uid, uid); err != nil {
@@ -92,33 +366,46 @@ func PrivelegeDrop(uid, gid int) {
 	}
 }
 
+func SetCapabilities(caps capability.Set) {
+	util.Bail(caps.Apply())
+}
+
 func SetRlimits(rlimits []rlimit.Rlimit) {
 	for _, rl := range rlimits {
 		util.Bail(rl.ApplyLimit())
 	}
 }
 
-func EnforceLandlock(files []string) {
-	if !landlock.Available() {
-		util.MessageBail("Landlock is not available")
-	}
-
-	var paths []*landlock.Path
+// rights the program needs in its working directory
+var workdirAccess = []string{"read_dir", "write_file", "make_reg"}
 
+// EnforceLandlock applies policy along with the legacy files entries. Once
+// any path is restricted, the dirs created for the run stay writable and
+// an existing working directory must be writable by the policy.
+func EnforceLandlock(policy landlock.Policy, files []string, workdir string, created []string) {
 	for _, v := range files {
-		lp, err := landlock.ParsePath(v)
+		rule, err := landlock.ParseFile(v)
 		util.Bail(err)
-		paths = append(paths, lp)
+		policy.Paths = append(policy.Paths, rule)
 	}
 
-	// no-op when landlock not configured
-	if len(paths) == 0 {
-		return
+	if len(policy.Paths) > 0 {
+		for _, dir := range created {
+			rule, err := landlock.ParseFile("d:rwc:" + dir)
+			util.Bail(err)
+			policy.Paths = append(policy.Paths, rule)
+		}
+
+		if !policy.Grants(workdir, workdirAccess...) {
+			util.MessageBail(fmt.Sprintf("landlock does not let the program write its working directory %s", workdir))
+		}
 	}
 
-	ll := landlock.New(paths...)
-	if err := ll.Lock(landlock.Mandatory); err != nil {
-		util.Bail(err)
+	warnings, err := policy.Enforce()
+	util.Bail(err)
+
+	for _, warning := range warnings {
+		util.Warn(warning)
 	}
 }
 
@@ -133,9 +420,11 @@ var namespacesMap map[string]uintptr = map[string]uintptr{
 	"TIME":   syscall.CLONE_NEWTIME,
 }
 
-// keep in mind that clone is blocked by docker default seccomp profile unless you have CAP_SYS_ADMIN
-// on Debian based system you need to enable kernel.unprivileged_userns_clone
-func GetNamespaceFlag(namespaces []string) uintptr {
+// GetNamespaceFlag returns the clone flags of namespaces. A rootful run
+// never gets a USER namespace. Keep in mind that clone is blocked by the
+// docker default seccomp profile without CAP_SYS_ADMIN, and Debian based
+// systems need kernel.unprivileged_userns_clone enabled.
+func GetNamespaceFlag(namespaces []string, rootful bool) uintptr {
 	var cloneFlags uintptr
 	for _, key := range namespaces {
 		if ns, ok := namespacesMap[key]; ok {
@@ -145,44 +434,80 @@ func GetNamespaceFlag(namespaces []string) uintptr {
 			util.Bail(err)
 		}
 	}
+
+	if rootful {
+		cloneFlags &^= syscall.CLONE_NEWUSER
+	}
+
 	return cloneFlags
 }
 
-func PivotRoot(newroot, rootfs string) {
-	// new_root and put_old must not be on the same mount as the current root.
-	if err := syscall.Mount("tmpfs", newroot, "tmpfs", 0, "size=64M,mode=755"); err != nil {
-		util.Bail(fmt.Errorf("failed to create tmpfs: %s", err.Error()))
-	}
+// EnterRoot makes root the root of the calling process. With a MNT
+// namespace the host root is pivoted away and detached, chroot is the
+// fallback.
+func EnterRoot(root string, namespaces []string) {
+	root, err := filepath.Abs(root)
+	util.Bail(err)
 
-	// put_old must be at or underneath new_root
-	putold := filepath.Join(newroot, ".pivot")
-	util.Bail(os.MkdirAll(putold, 0o700))
+	if slices.Contains(namespaces, "MNT") {
+		err := PivotRoot(root)
+		if err == nil {
+			return
+		}
 
-	util.CopyRootFs(rootfs, newroot)
-	util.MountProc(newroot)
-	util.MountBindDev(newroot)
+		util.Warn(fmt.Sprintf("pivot_root failed, falling back to chroot %s", err.Error()))
+	} else {
+		util.Warn("without a MNT namespace the host mounts are only hidden by chroot")
+	}
 
-	util.Bail(syscall.PivotRoot(newroot, putold))
+	if err := syscall.Chroot(root); err != nil {
+		util.Bail(fmt.Errorf("failed to chroot %s", err.Error()))
+	}
 
 	if err := os.Chdir("/"); err != nil {
-		util.MessageBail("failed to change dir after pivot root")
+		util.MessageBail("failed to change dir after chroot")
+	}
+}
+
+// PivotRoot swaps the root of the calling mount namespace for root, which
+// has to be a mount point, and detaches the old one
+func PivotRoot(root string) error {
+	// pivot_root refuses shared mounts, only our copy of them changes
+	if err := syscall.Mount("", "/", "", syscall.MS_PRIVATE|syscall.MS_REC, ""); err != nil {
+		return fmt.Errorf("failed to make / private %s", err.Error())
+	}
+
+	if err := os.Chdir(root); err != nil {
+		return err
 	}
 
-	if err := syscall.Unmount("/.pivot", syscall.MNT_DETACH); err != nil {
-		util.Bail(fmt.Errorf("failed to unmount pivot: %s", err.Error()))
+	// the old root ends up stacked on the new one, no put_old is needed
+	if err := syscall.PivotRoot(".", "."); err != nil {
+		return err
 	}
 
-	os.RemoveAll("/.pivot")
+	if err := syscall.Unmount(".", syscall.MNT_DETACH); err != nil {
+		util.Bail(fmt.Errorf("failed to detach the old root %s", err.Error()))
+	}
+
+	if err := os.Chdir("/"); err != nil {
+		util.MessageBail("failed to change dir after pivot root")
+	}
+
+	return nil
 }
 
-func PreChroot(root string, binds []configs.Bind) {
+func PreChroot(root string, config configs.KalengConfig) {
 	_, err := os.Stat(root)
 	if err != nil {
 		err = fmt.Errorf("error when checking root %s %v", root, err)
 		util.Bail(err)
 	}
 
-	for _, bind := range binds {
+	// without a USER namespace the mounts below would propagate back
+	util.PrivateMount(root)
+
+	for _, bind := range config.Binds {
 		if bind.Target == "" {
 			bind.Target = bind.Source
 		}
@@ -193,13 +518,66 @@ func PreChroot(root string, binds []configs.Bind) {
 	}
 
 	util.MountProc(root)
-	util.MountBindDev(root)
+	util.MountBindDev(root, devices(config), shmMount(config))
 	util.MountCGroupV2(root)
-	util.MountMnt(root, 64*1024*1024)
+
+	for _, tmpfs := range tmpfsMounts(config) {
+		util.MountTmpfs(root, tmpfs)
+	}
 }
 
-func CleanChroot(root string, binds []configs.Bind) {
-	for _, bind := range binds {
+// ServeRandom replaces the random devices of root with a stream seeded with
+// seed, the returned func stops it
+func ServeRandom(root string, seed uint64) func() {
+	var stops []func()
+	for _, dev := range configs.RandomDevices {
+		stop, err := util.ServeRandom(filepath.Join(root, dev), seed)
+		util.Bail(err)
+		stops = append(stops, stop)
+	}
+
+	return func() {
+		for _, stop := range stops {
+			stop()
+		}
+	}
+}
+
+func tmpfsMounts(config configs.KalengConfig) []configs.Tmpfs {
+	if len(config.Tmpfs) == 0 {
+		return configs.DefaultTmpfs
+	}
+
+	return config.Tmpfs
+}
+
+func devices(config configs.KalengConfig) []configs.Device {
+	devices := config.Devices
+	if len(devices) == 0 {
+		devices = configs.DefaultDevices
+	}
+
+	// ServeRandom takes their place
+	if config.Deterministic {
+		devices = slices.DeleteFunc(slices.Clone(devices), func(dev configs.Device) bool {
+			return slices.Contains(configs.RandomDevices, filepath.Clean(dev.Path))
+		})
+	}
+
+	return devices
+}
+
+func shmMount(config configs.KalengConfig) configs.Tmpfs {
+	size := config.ShmSize
+	if size == 0 {
+		size = configs.DefaultShmSize
+	}
+
+	return configs.Tmpfs{Path: "/dev/shm", Size: size, Mode: "1777", NoExec: true}
+}
+
+func CleanChroot(root string, config configs.KalengConfig) {
+	for _, bind := range config.Binds {
 		target := bind.Target
 		if target == "" {
 			target = bind.Source
@@ -209,10 +587,14 @@ func CleanChroot(root string, binds []configs.Bind) {
 		util.BindUnmount(target)
 	}
 
-	util.BindUnmount(filepath.Join(root, "tmp"))
+	for _, tmpfs := range tmpfsMounts(config) {
+		util.BindUnmount(filepath.Join(root, tmpfs.Path))
+	}
+
 	util.UnmoutProc(root)
-	util.UnmoutDev(root)
+	util.UnmoutDev(root, devices(config), shmMount(config))
 	util.UnmountCGroup(root)
+	util.BindUnmount(root)
 
 	err := os.RemoveAll(root)
 	if err != nil {
@@ -224,16 +606,29 @@ func CleanChroot(root string, binds []configs.Bind) {
 	util.Bail(err)
 }
 
-func CGroup(name string, config configs.Cgroup) *cgroup.CGroup {
+// CGroup creates the run's cgroup, canceled stops waiting for a cpu from
+// the cpuset pool
+func CGroup(name string, config configs.Cgroup, canceled func() bool) *cgroup.CGroup {
+	if config.Cpuset.Pool != "" {
+		cpu, err := cgroup.AllocateCpu(config.Cpuset.Pool, time.Duration(config.Cpuset.Wait), canceled)
+		util.Bail(err)
+		config.Cpuset.Cpus = strconv.Itoa(cpu)
+	}
+
 	cg, err := cgroup.New(name)
 	util.Bail(err)
 
 	cg.SetCpu(config.Cpu)
+	cg.SetCpuset(config.Cpuset)
+	cg.SetIo(config.Io)
 	cg.SetMaximumMemory(config.MaxMemory)
+	cg.SetMemoryHigh(config.MemoryHigh)
+	cg.SetMemoryLow(config.MemoryLow)
+	cg.SetMaximumSwap(config.MemorySwapMax)
+	cg.SetMaximumZswap(config.MemoryZswapMax)
 	cg.SetMaximumPids(config.MaxPids)
 	cg.SetMaximumDepth(config.MaxDepth)
 	cg.SetMaximumDescendants(config.MaxDescendants)
-	cg.DisableSwap()
 
 	return cg
 }
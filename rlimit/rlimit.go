@@ -2,46 +2,102 @@ package rlimit
 
 import (
 	"fmt"
-	"syscall"
+	"time"
+
+	"codeberg.org/iklabib/kaleng/units"
+	"golang.org/x/sys/unix"
 )
 
 const (
-	RLIMIT_AS     = "RLIMIT_AS"
-	RLIMIT_CPU    = "RLIMIT_CPU"
-	RLIMIT_CORE   = "RLIMIT_CORE"
-	RLIMIT_DATA   = "RLIMIT_DATA"
-	RLIMIT_FSIZE  = "RLIMIT_FSIZE"
-	RLIMIT_NOFILE = "RLIMIT_NOFILE"
-	RLIMIT_STACK  = "RLIMIT_STACK"
+	RLIMIT_AS         = "RLIMIT_AS"
+	RLIMIT_CPU        = "RLIMIT_CPU"
+	RLIMIT_CORE       = "RLIMIT_CORE"
+	RLIMIT_DATA       = "RLIMIT_DATA"
+	RLIMIT_FSIZE      = "RLIMIT_FSIZE"
+	RLIMIT_NOFILE     = "RLIMIT_NOFILE"
+	RLIMIT_STACK      = "RLIMIT_STACK"
+	RLIMIT_NPROC      = "RLIMIT_NPROC"
+	RLIMIT_MEMLOCK    = "RLIMIT_MEMLOCK"
+	RLIMIT_MSGQUEUE   = "RLIMIT_MSGQUEUE"
+	RLIMIT_NICE       = "RLIMIT_NICE"
+	RLIMIT_RTPRIO     = "RLIMIT_RTPRIO"
+	RLIMIT_RTTIME     = "RLIMIT_RTTIME"
+	RLIMIT_SIGPENDING = "RLIMIT_SIGPENDING"
+	RLIMIT_LOCKS      = "RLIMIT_LOCKS"
+	RLIMIT_RSS        = "RLIMIT_RSS"
 )
 
+// Soft and Hard take the unit of the resource, e.g. 64MiB for RLIMIT_AS or
+// 1s for RLIMIT_CPU, or unlimited
 type Rlimit struct {
-	Resource string `config:"resource" yaml:"resource" json:"resource"`
-	Soft     uint64 `config:"soft" yaml:"soft" json:"soft"`
-	Hard     uint64 `config:"hard" yaml:"soft" json:"hard"`
+	Resource string      `config:"resource" yaml:"resource" json:"resource"`
+	Soft     units.Limit `config:"soft" yaml:"soft" json:"soft"`
+	Hard     units.Limit `config:"hard" yaml:"hard" json:"hard"`
+}
+
+type resource struct {
+	id    int
+	parse func(units.Limit) (uint64, error)
+}
+
+func size(l units.Limit) (uint64, error)         { return l.Size() }
+func count(l units.Limit) (uint64, error)        { return l.Count() }
+func seconds(l units.Limit) (uint64, error)      { return l.Duration(time.Second) }
+func microseconds(l units.Limit) (uint64, error) { return l.Duration(time.Microsecond) }
+
+var resources = map[string]resource{
+	RLIMIT_AS:         {unix.RLIMIT_AS, size},
+	RLIMIT_CPU:        {unix.RLIMIT_CPU, seconds},
+	RLIMIT_CORE:       {unix.RLIMIT_CORE, size},
+	RLIMIT_DATA:       {unix.RLIMIT_DATA, size},
+	RLIMIT_FSIZE:      {unix.RLIMIT_FSIZE, size},
+	RLIMIT_NOFILE:     {unix.RLIMIT_NOFILE, count},
+	RLIMIT_STACK:      {unix.RLIMIT_STACK, size},
+	RLIMIT_NPROC:      {unix.RLIMIT_NPROC, count},
+	RLIMIT_MEMLOCK:    {unix.RLIMIT_MEMLOCK, size},
+	RLIMIT_MSGQUEUE:   {unix.RLIMIT_MSGQUEUE, size},
+	RLIMIT_NICE:       {unix.RLIMIT_NICE, count}, // ceiling of 20 - nice
+	RLIMIT_RTPRIO:     {unix.RLIMIT_RTPRIO, count},
+	RLIMIT_RTTIME:     {unix.RLIMIT_RTTIME, microseconds},
+	RLIMIT_SIGPENDING: {unix.RLIMIT_SIGPENDING, count},
+	RLIMIT_LOCKS:      {unix.RLIMIT_LOCKS, count},
+	RLIMIT_RSS:        {unix.RLIMIT_RSS, size}, // ignored since linux 2.6
+}
+
+func (rl Rlimit) limit() (int, *unix.Rlimit, error) {
+	res, ok := resources[rl.Resource]
+	if !ok {
+		return 0, nil, fmt.Errorf("unknown rlimit resource option '%s'", rl.Resource)
+	}
+
+	soft, err := res.parse(rl.Soft)
+	if err != nil {
+		return 0, nil, fmt.Errorf("%s soft: %v", rl.Resource, err)
+	}
+
+	hard, err := res.parse(rl.Hard)
+	if err != nil {
+		return 0, nil, fmt.Errorf("%s hard: %v", rl.Resource, err)
+	}
+
+	if soft > hard {
+		return 0, nil, fmt.Errorf("%s soft limit exceeds hard limit", rl.Resource)
+	}
+
+	return res.id, &unix.Rlimit{Cur: soft, Max: hard}, nil
+}
+
+// Validate checks the resource is known and soft does not exceed hard
+func (rl Rlimit) Validate() error {
+	_, _, err := rl.limit()
+	return err
 }
 
 func (rl Rlimit) ApplyLimit() error {
-	resource := -1
-	switch rl.Resource {
-	case RLIMIT_AS:
-		resource = syscall.RLIMIT_AS
-	case RLIMIT_CPU:
-		resource = syscall.RLIMIT_CPU
-	case RLIMIT_CORE:
-		resource = syscall.RLIMIT_CORE
-	case RLIMIT_DATA:
-		resource = syscall.RLIMIT_DATA
-	case RLIMIT_FSIZE:
-		resource = syscall.RLIMIT_FSIZE
-	case RLIMIT_NOFILE:
-		resource = syscall.RLIMIT_NOFILE
-	case RLIMIT_STACK:
-		resource = syscall.RLIMIT_STACK
-	default:
-		return fmt.Errorf("unknown rlimit resource option '%s'", rl.Resource)
+	resource, limit, err := rl.limit()
+	if err != nil {
+		return err
 	}
 
-	limit := &syscall.Rlimit{Cur: rl.Soft, Max: rl.Hard}
-	return syscall.Setrlimit(resource, limit)
+	return unix.Setrlimit(resource, limit)
 }
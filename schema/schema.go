@@ -0,0 +1,194 @@
+package schema
+
+import (
+	"math"
+	"reflect"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"codeberg.org/iklabib/kaleng/configs"
+	"codeberg.org/iklabib/kaleng/model"
+	"codeberg.org/iklabib/kaleng/units"
+	"github.com/elastic/go-seccomp-bpf"
+)
+
+const draft = "https://json-schema.org/draft/2020-12/schema"
+
+// Schema is the subset of JSON Schema kaleng emits and validates.
+// AdditionalProperties is either false or a *Schema.
+type Schema struct {
+	Schema               string             `json:"$schema,omitempty"`
+	Title                string             `json:"title,omitempty"`
+	Description          string             `json:"description,omitempty"`
+	Ref                  string             `json:"$ref,omitempty"`
+	Type                 string             `json:"type,omitempty"`
+	Enum                 []interface{}      `json:"enum,omitempty"`
+	Minimum              *float64           `json:"minimum,omitempty"`
+	Maximum              *float64           `json:"maximum,omitempty"`
+	Pattern              string             `json:"pattern,omitempty"`
+	Items                *Schema            `json:"items,omitempty"`
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	AdditionalProperties interface{}        `json:"additionalProperties,omitempty"`
+	AnyOf                []*Schema          `json:"anyOf,omitempty"`
+	Defs                 map[string]*Schema `json:"$defs,omitempty"`
+}
+
+// Config describes what the config loader takes, field names follow the
+// config struct tags
+var Config = sync.OnceValue(func() *Schema {
+	s := generate(reflect.TypeOf(configs.KalengConfig{}), "config")
+	s.Title = "kaleng config"
+
+	// resolved by the loader before the config is unpacked
+	s.Properties["extends"] = &Schema{Type: "string", Description: "profile merged underneath, relative to this file"}
+	s.Properties["append"] = &Schema{Type: "array", Items: &Schema{Type: "string"}, Description: "lists appended to the extended profile instead of replacing it"}
+
+	return s
+})
+
+// Result describes what execute prints, field names follow the json
+// struct tags
+var Result = sync.OnceValue(func() *Schema {
+	s := generate(reflect.TypeOf(model.Result{}), "json")
+	s.Title = "kaleng result"
+	return s
+})
+
+// types that unpack from more than their kind suggests
+var custom = map[reflect.Type]*Schema{
+	reflect.TypeOf(units.Size(0)): anyOf("bytes, or a size like 64MiB, max for no limit",
+		&Schema{Type: "integer", Minimum: bound(0)}, &Schema{Type: "string"}),
+	reflect.TypeOf(units.Duration(0)): anyOf("seconds, or a duration like 250ms",
+		&Schema{Type: "number", Minimum: bound(0)}, &Schema{Type: "string"}),
+	reflect.TypeOf(units.Microseconds(0)): anyOf("microseconds, or a duration like 12.5ms, max for no limit",
+		&Schema{Type: "number", Minimum: bound(0)}, &Schema{Type: "string"}),
+	reflect.TypeOf(units.Limit("")): anyOf("as the resource counts, or with a unit like 64MiB or 1s, unlimited for no limit",
+		&Schema{Type: "number", Minimum: bound(0)}, &Schema{Type: "string"}),
+	reflect.TypeOf(configs.Envs{}): anyOf("set in order, a map is set in the order of its names",
+		&Schema{Type: "object", AdditionalProperties: &Schema{AnyOf: []*Schema{{Type: "string"}, {Type: "number"}, {Type: "boolean"}}}},
+		&Schema{Type: "array", Items: &Schema{AnyOf: []*Schema{
+			{Type: "string", Pattern: "^[^=]+="},
+			{
+				Type:                 "object",
+				Properties:           map[string]*Schema{"name": {Type: "string"}, "value": {AnyOf: []*Schema{{Type: "string"}, {Type: "number"}, {Type: "boolean"}}}},
+				AdditionalProperties: false,
+			},
+		}}}),
+	reflect.TypeOf(seccomp.Action(0)): {
+		Type:        "string",
+		Description: "kill_thread, kill_process, trap, errno, trace, log or allow",
+	},
+	reflect.TypeOf(seccomp.Operation("")): {
+		Type:        "string",
+		Description: "Equal, NotEqual, GreaterThan, LessThan, GreaterOrEqual, LessOrEqual, BitsSet or BitsNotSet",
+	},
+	reflect.TypeOf(time.Duration(0)):  {Type: "integer", Description: "nanoseconds"},
+	reflect.TypeOf(syscall.Signal(0)): {Type: "integer", Minimum: bound(0), Description: "signal number of a killed program, 0 if it exited"},
+}
+
+type generator struct {
+	tag  string
+	defs map[string]*Schema
+}
+
+// generate describes t, named structs beneath it go to $defs
+func generate(t reflect.Type, tag string) *Schema {
+	g := generator{tag: tag, defs: map[string]*Schema{}}
+	s := g.object(t)
+	s.Schema = draft
+	s.Defs = g.defs
+
+	return s
+}
+
+func (g *generator) schemaOf(t reflect.Type) *Schema {
+	if s, ok := custom[t]; ok {
+		return s
+	}
+
+	switch t.Kind() {
+	case reflect.Pointer:
+		return &Schema{AnyOf: []*Schema{g.schemaOf(t.Elem()), {Type: "null"}}}
+	case reflect.Bool:
+		return &Schema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		bits := t.Bits()
+		if bits == 64 {
+			return &Schema{Type: "integer"}
+		}
+		return &Schema{Type: "integer", Minimum: bound(-math.Exp2(float64(bits - 1))), Maximum: bound(math.Exp2(float64(bits-1)) - 1)}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		bits := t.Bits()
+		if bits == 64 {
+			return &Schema{Type: "integer", Minimum: bound(0)}
+		}
+		return &Schema{Type: "integer", Minimum: bound(0), Maximum: bound(math.Exp2(float64(bits)) - 1)}
+	case reflect.Float32, reflect.Float64:
+		return &Schema{Type: "number"}
+	case reflect.String:
+		return &Schema{Type: "string"}
+	case reflect.Slice, reflect.Array:
+		return &Schema{Type: "array", Items: g.schemaOf(t.Elem())}
+	case reflect.Map:
+		return &Schema{Type: "object", AdditionalProperties: g.schemaOf(t.Elem())}
+	case reflect.Struct:
+		// e.g. configs.Bind
+		name := t.String()
+		if _, ok := g.defs[name]; !ok {
+			// taken before recursing in case t refers to itself
+			g.defs[name] = &Schema{}
+			*g.defs[name] = *g.object(t)
+		}
+		return &Schema{Ref: "#/$defs/" + name}
+	default:
+		// anything
+		return &Schema{}
+	}
+}
+
+func (g *generator) object(t reflect.Type) *Schema {
+	s := &Schema{Type: "object", Properties: map[string]*Schema{}, AdditionalProperties: false}
+	g.fields(t, s)
+	return s
+}
+
+func (g *generator) fields(t reflect.Type, s *Schema) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name, opts, _ := strings.Cut(f.Tag.Get(g.tag), ",")
+		if name == "-" || strings.Contains(opts, "ignore") {
+			continue
+		}
+
+		// untagged embedded structs are flattened like go-ucfg and
+		// encoding/json do
+		if f.Anonymous && f.Type.Kind() == reflect.Struct && (name == "" || strings.Contains(opts, "inline")) {
+			g.fields(f.Type, s)
+			continue
+		}
+
+		if !f.IsExported() {
+			continue
+		}
+
+		if name == "" {
+			name = f.Name
+			// go-ucfg matches untagged fields in lower case
+			if g.tag == "config" {
+				name = strings.ToLower(name)
+			}
+		}
+
+		s.Properties[name] = g.schemaOf(f.Type)
+	}
+}
+
+func anyOf(description string, schemas ...*Schema) *Schema {
+	return &Schema{Description: description, AnyOf: schemas}
+}
+
+func bound(v float64) *float64 {
+	return &v
+}
@@ -0,0 +1,281 @@
+package schema
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Validate checks v, as decoded from YAML or JSON, against s. Null leaves
+// a field unset so it always passes.
+func (s *Schema) Validate(v interface{}) error {
+	return s.validate(s, "", v)
+}
+
+func (s *Schema) validate(root *Schema, path string, v interface{}) error {
+	if v == nil {
+		return nil
+	}
+
+	if s.Ref != "" {
+		return s.resolve(root).validate(root, path, v)
+	}
+
+	if len(s.AnyOf) > 0 {
+		var matched []error
+		for _, sub := range s.AnyOf {
+			err := sub.validate(root, path, v)
+			if err == nil {
+				return nil
+			}
+
+			if isType(sub.describe(root), v) {
+				matched = append(matched, err)
+			}
+		}
+
+		// the reason is clearer from the only alternative of its type
+		if len(matched) == 1 {
+			return matched[0]
+		}
+
+		return fmt.Errorf("%s: expected %s, got %s", at(path), s.describe(root), typeOf(v))
+	}
+
+	if s.Type != "" && !isType(s.Type, v) {
+		return fmt.Errorf("%s: expected %s, got %s", at(path), s.Type, typeOf(v))
+	}
+
+	if len(s.Enum) > 0 && !slices.Contains(s.Enum, v) {
+		return fmt.Errorf("%s: expected one of %v, got %v", at(path), s.Enum, v)
+	}
+
+	if n, ok := number(v); ok {
+		if s.Minimum != nil && n < *s.Minimum {
+			return fmt.Errorf("%s: %v is below %v", at(path), v, *s.Minimum)
+		}
+
+		if s.Maximum != nil && n > *s.Maximum {
+			return fmt.Errorf("%s: %v is above %v", at(path), v, *s.Maximum)
+		}
+	}
+
+	if str, ok := v.(string); ok && s.Pattern != "" {
+		if !regexp.MustCompile(s.Pattern).MatchString(str) {
+			return fmt.Errorf("%s: '%s' does not match %s", at(path), str, s.Pattern)
+		}
+	}
+
+	switch v := v.(type) {
+	case []interface{}:
+		if s.Items == nil {
+			return nil
+		}
+
+		for i, item := range v {
+			if err := s.Items.validate(root, fmt.Sprintf("%s[%d]", path, i), item); err != nil {
+				return err
+			}
+		}
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		slices.Sort(keys)
+
+		for _, key := range keys {
+			field := join(path, key)
+			prop, ok := s.Properties[key]
+			if !ok {
+				switch additional := s.AdditionalProperties.(type) {
+				case *Schema:
+					prop = additional
+				case bool:
+					if !additional {
+						return fmt.Errorf("%s: unknown field", field)
+					}
+					continue
+				default:
+					continue
+				}
+			}
+
+			if err := prop.validate(root, field, v[key]); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Field looks up the schema of a dotted path like binds.0.source, nil if
+// there is none
+func (s *Schema) Field(path string) *Schema {
+	field := s
+	for _, key := range strings.Split(path, ".") {
+		field = field.resolve(s)
+		// e.g. a pointer to a struct is that struct or null
+		for _, sub := range field.AnyOf {
+			if sub := sub.resolve(s); sub.Type == "object" || sub.Type == "array" {
+				field = sub
+				break
+			}
+		}
+
+		switch {
+		case field.Items != nil:
+			if _, err := strconv.Atoi(key); err != nil {
+				return nil
+			}
+			field = field.Items
+		case field.Properties[key] != nil:
+			field = field.Properties[key]
+		default:
+			if additional, ok := field.AdditionalProperties.(*Schema); ok {
+				field = additional
+				continue
+			}
+			return nil
+		}
+	}
+
+	return field.resolve(s)
+}
+
+func (s *Schema) resolve(root *Schema) *Schema {
+	if s.Ref == "" {
+		return s
+	}
+
+	def, ok := root.Defs[strings.TrimPrefix(s.Ref, "#/$defs/")]
+	if !ok {
+		// anything
+		return &Schema{}
+	}
+
+	return def
+}
+
+// e.g. integer or string
+func (s *Schema) describe(root *Schema) string {
+	if s.Ref != "" {
+		return s.resolve(root).describe(root)
+	}
+
+	if len(s.AnyOf) == 0 {
+		return s.Type
+	}
+
+	var types []string
+	for _, sub := range s.AnyOf {
+		if t := sub.describe(root); t != "" && !slices.Contains(types, t) {
+			types = append(types, t)
+		}
+	}
+
+	return strings.Join(types, " or ")
+}
+
+func isType(t string, v interface{}) bool {
+	switch t {
+	case "null":
+		return v == nil
+	case "boolean":
+		_, ok := v.(bool)
+		return ok
+	case "string":
+		// go-ucfg unpacks any scalar into a string
+		switch v.(type) {
+		case string, bool:
+			return true
+		}
+		_, ok := number(v)
+		return ok
+	case "number":
+		_, ok := number(v)
+		return ok
+	case "integer":
+		// go-ucfg parses a quoted integer, not a quoted 1.0
+		if s, ok := v.(string); ok {
+			_, errInt := strconv.ParseInt(s, 0, 64)
+			_, errUint := strconv.ParseUint(s, 0, 64)
+			return errInt == nil || errUint == nil
+		}
+		n, ok := number(v)
+		return ok && n == math.Trunc(n)
+	case "array":
+		_, ok := v.([]interface{})
+		return ok
+	case "object":
+		_, ok := v.(map[string]interface{})
+		return ok
+	default:
+		return true
+	}
+}
+
+func number(v interface{}) (float64, bool) {
+	switch v := v.(type) {
+	case int:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	case float64:
+		return v, true
+	case string:
+		// go-ucfg unpacks quoted numbers like "50" into numeric fields
+		n, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			i, err := strconv.ParseInt(v, 0, 64)
+			return float64(i), err == nil
+		}
+		return n, true
+	default:
+		return 0, false
+	}
+}
+
+func typeOf(v interface{}) string {
+	switch v.(type) {
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+
+	if n, ok := number(v); ok {
+		if n == math.Trunc(n) {
+			return "integer"
+		}
+		return "number"
+	}
+
+	return fmt.Sprintf("%T", v)
+}
+
+func join(path, key string) string {
+	if path == "" {
+		return key
+	}
+
+	return path + "." + key
+}
+
+func at(path string) string {
+	if path == "" {
+		return "(root)"
+	}
+
+	return path
+}
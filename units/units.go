@@ -0,0 +1,290 @@
+// Package units parses human readable sizes and durations used across the
+// configuration, e.g. 512MiB, 1.5s, 250ms or unlimited.
+package units
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Size is a byte count. Plain numbers are bytes, suffixes K, M, G, T (also
+// written Ki, KiB, ...) are powers of 1024 like the kernel takes them while
+// kB, MB, GB, TB are powers of 1000.
+type Size uint64
+
+// Unlimited is also RLIM_INFINITY
+const Unlimited Size = math.MaxUint64
+
+var sizeSuffixes = map[string]float64{
+	"":    1,
+	"b":   1,
+	"k":   1 << 10,
+	"ki":  1 << 10,
+	"kib": 1 << 10,
+	"kb":  1e3,
+	"m":   1 << 20,
+	"mi":  1 << 20,
+	"mib": 1 << 20,
+	"mb":  1e6,
+	"g":   1 << 30,
+	"gi":  1 << 30,
+	"gib": 1 << 30,
+	"gb":  1e9,
+	"t":   1 << 40,
+	"ti":  1 << 40,
+	"tib": 1 << 40,
+	"tb":  1e12,
+}
+
+func ParseSize(s string) (Size, error) {
+	s = strings.TrimSpace(s)
+	if isUnlimited(s) {
+		return Unlimited, nil
+	}
+
+	number, suffix := splitNumber(s)
+	multiplier, ok := sizeSuffixes[strings.ToLower(suffix)]
+	if !ok || number == "" {
+		return 0, fmt.Errorf("invalid size '%s'", s)
+	}
+
+	val, err := strconv.ParseFloat(number, 64)
+	if err != nil || val < 0 {
+		return 0, fmt.Errorf("invalid size '%s'", s)
+	}
+
+	bytes := val * multiplier
+	if bytes >= math.MaxUint64 {
+		return 0, fmt.Errorf("size '%s' out of range", s)
+	}
+
+	return Size(bytes), nil
+}
+
+// in the format cgroup and mount options take
+func (s Size) String() string {
+	if s == Unlimited {
+		return "max"
+	}
+
+	return strconv.FormatUint(uint64(s), 10)
+}
+
+func (s *Size) Unpack(v interface{}) error {
+	switch v := v.(type) {
+	case int64:
+		if v < 0 {
+			return fmt.Errorf("invalid size %d", v)
+		}
+		*s = Size(v)
+	case uint64:
+		*s = Size(v)
+	case float64:
+		if v < 0 || math.IsNaN(v) {
+			return fmt.Errorf("invalid size %v", v)
+		}
+		// float64(math.MaxUint64) rounds up to 2^64
+		if v >= math.MaxUint64 {
+			return fmt.Errorf("size %v out of range", v)
+		}
+		*s = Size(v)
+	case string:
+		size, err := ParseSize(v)
+		if err != nil {
+			return err
+		}
+		*s = size
+	default:
+		return fmt.Errorf("invalid size %v", v)
+	}
+
+	return nil
+}
+
+// Duration takes Go durations like 1.5s or 250ms, plain numbers are
+// seconds.
+type Duration time.Duration
+
+func (d *Duration) Unpack(v interface{}) error {
+	parsed, err := unpackDuration(v, time.Second)
+	if err != nil {
+		return err
+	}
+
+	*d = Duration(parsed)
+	return nil
+}
+
+// Microseconds takes Go durations like Duration, but plain numbers are
+// microseconds as cgroup cpu.max takes them.
+type Microseconds time.Duration
+
+func (d *Microseconds) Unpack(v interface{}) error {
+	parsed, err := unpackDuration(v, time.Microsecond)
+	if err != nil {
+		return err
+	}
+
+	*d = Microseconds(parsed)
+	return nil
+}
+
+// in microseconds or max
+func (d Microseconds) String() string {
+	if time.Duration(d) == UnlimitedDuration {
+		return "max"
+	}
+
+	return strconv.FormatInt(time.Duration(d).Microseconds(), 10)
+}
+
+// UnlimitedDuration is the longest representable duration
+const UnlimitedDuration time.Duration = math.MaxInt64
+
+// ParseDuration parses Go durations, plain numbers are multiples of unit.
+func ParseDuration(s string, unit time.Duration) (time.Duration, error) {
+	s = strings.TrimSpace(s)
+	if isUnlimited(s) {
+		return UnlimitedDuration, nil
+	}
+
+	if val, err := strconv.ParseFloat(s, 64); err == nil {
+		return fromFloat(val, unit, s)
+	}
+
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid duration '%s'", s)
+	}
+
+	return d, nil
+}
+
+func unpackDuration(v interface{}, unit time.Duration) (time.Duration, error) {
+	switch v := v.(type) {
+	case int64:
+		return fromFloat(float64(v), unit, v)
+	case uint64:
+		return fromFloat(float64(v), unit, v)
+	case float64:
+		return fromFloat(v, unit, v)
+	case string:
+		return ParseDuration(v, unit)
+	default:
+		return 0, fmt.Errorf("invalid duration %v", v)
+	}
+}
+
+func fromFloat(val float64, unit time.Duration, orig interface{}) (time.Duration, error) {
+	if val < 0 || math.IsNaN(val) {
+		return 0, fmt.Errorf("invalid duration '%v'", orig)
+	}
+
+	d := val * float64(unit)
+	if d >= math.MaxInt64 {
+		return 0, fmt.Errorf("duration '%v' out of range", orig)
+	}
+
+	return time.Duration(d), nil
+}
+
+// Limit keeps the raw value of a limit whose unit depends on what it
+// limits, e.g. rlimits. Plain numbers are kept as written.
+type Limit string
+
+func (l *Limit) Unpack(v interface{}) error {
+	switch v := v.(type) {
+	case int64:
+		if v < 0 {
+			return fmt.Errorf("invalid limit %d", v)
+		}
+		*l = Limit(strconv.FormatInt(v, 10))
+	case uint64:
+		*l = Limit(strconv.FormatUint(v, 10))
+	case float64:
+		*l = Limit(strconv.FormatFloat(v, 'f', -1, 64))
+	case string:
+		*l = Limit(strings.TrimSpace(v))
+	default:
+		return fmt.Errorf("invalid limit %v", v)
+	}
+
+	return nil
+}
+
+// Size parses the limit as bytes, unlimited is math.MaxUint64
+func (l Limit) Size() (uint64, error) {
+	if l == "" {
+		return 0, nil
+	}
+
+	size, err := ParseSize(string(l))
+	return uint64(size), err
+}
+
+// Count parses the limit as a plain number, unlimited is math.MaxUint64
+func (l Limit) Count() (uint64, error) {
+	if l == "" {
+		return 0, nil
+	}
+
+	if isUnlimited(string(l)) {
+		return math.MaxUint64, nil
+	}
+
+	count, err := strconv.ParseUint(string(l), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid count '%s'", l)
+	}
+
+	return count, nil
+}
+
+// Duration parses the limit as a duration counted in unit, rounding up.
+// Plain numbers are multiples of unit, unlimited is math.MaxUint64.
+func (l Limit) Duration(unit time.Duration) (uint64, error) {
+	if l == "" {
+		return 0, nil
+	}
+
+	d, err := ParseDuration(string(l), unit)
+	if err != nil {
+		return 0, err
+	}
+
+	if d == UnlimitedDuration {
+		return math.MaxUint64, nil
+	}
+
+	// d + unit - 1 would overflow near math.MaxInt64
+	count := d / unit
+	if d%unit != 0 {
+		count++
+	}
+
+	return uint64(count), nil
+}
+
+func isUnlimited(s string) bool {
+	switch strings.ToLower(s) {
+	case "unlimited", "infinity", "max":
+		return true
+	}
+
+	return false
+}
+
+// split 1.5GiB into 1.5 and GiB
+func splitNumber(s string) (string, string) {
+	i := strings.IndexFunc(s, func(r rune) bool {
+		return (r < '0' || r > '9') && r != '.'
+	})
+	if i < 0 {
+		return s, ""
+	}
+
+	return s[:i], strings.TrimSpace(s[i:])
+}
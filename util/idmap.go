@@ -0,0 +1,134 @@
+package util
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"codeberg.org/iklabib/kaleng/configs"
+)
+
+const (
+	SubuidFile = "/etc/subuid"
+	SubgidFile = "/etc/subgid"
+)
+
+// IdMappings resolves mappings into what the kernel takes, subordinate
+// host ids are looked up in file under username. id has to be mapped as the
+// sandbox runs as it.
+func IdMappings(mappings []configs.IdMap, id int, file, username string) ([]syscall.SysProcIDMap, error) {
+	var ranges [][2]int
+	var resolved []syscall.SysProcIDMap
+	covered := false
+
+	for _, m := range mappings {
+		hostID := m.HostID
+		if m.Subordinate {
+			if ranges == nil {
+				var err error
+				if ranges, err = SubordinateRanges(file, username); err != nil {
+					return nil, err
+				}
+			}
+
+			var err error
+			if hostID, err = subordinateID(ranges, m.HostID, m.Size); err != nil {
+				return nil, fmt.Errorf("%s: %s", file, err.Error())
+			}
+		}
+
+		for _, prev := range resolved {
+			if overlaps(prev.ContainerID, prev.Size, m.ContainerID, m.Size) {
+				return nil, fmt.Errorf("id mapping for %d overlaps %d", m.ContainerID, prev.ContainerID)
+			}
+		}
+
+		if id >= m.ContainerID && id < m.ContainerID+m.Size {
+			covered = true
+		}
+
+		resolved = append(resolved, syscall.SysProcIDMap{
+			ContainerID: m.ContainerID,
+			HostID:      hostID,
+			Size:        m.Size,
+		})
+	}
+
+	if !covered {
+		return nil, fmt.Errorf("id %d is not mapped", id)
+	}
+
+	return resolved, nil
+}
+
+// SubordinateRanges lists the start and size of the ranges file grants to
+// username, entries name the user or its uid. The supervisor runs as root,
+// so the ranges are those of the user the sandbox runs as.
+func SubordinateRanges(file, username string) ([][2]int, error) {
+	owner, err := user.Lookup(username)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var ranges [][2]int
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Split(strings.TrimSpace(scanner.Text()), ":")
+		if len(fields) != 3 || (fields[0] != owner.Username && fields[0] != owner.Uid) {
+			continue
+		}
+
+		start, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("%s: malformed entry '%s'", file, scanner.Text())
+		}
+
+		size, err := strconv.Atoi(fields[2])
+		if err != nil {
+			return nil, fmt.Errorf("%s: malformed entry '%s'", file, scanner.Text())
+		}
+
+		ranges = append(ranges, [2]int{start, size})
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(ranges) == 0 {
+		return nil, fmt.Errorf("%s: no range for %s", file, owner.Username)
+	}
+
+	return ranges, nil
+}
+
+// offset counts across every range in the order they are listed
+func subordinateID(ranges [][2]int, offset, size int) (int, error) {
+	for _, r := range ranges {
+		if offset < r[1] {
+			if offset+size > r[1] {
+				return 0, fmt.Errorf("%d ids at offset %d cross a range boundary", size, offset)
+			}
+
+			return r[0] + offset, nil
+		}
+
+		offset -= r[1]
+	}
+
+	return 0, fmt.Errorf("offset past the subordinate ranges")
+}
+
+func overlaps(a, aSize, b, bSize int) bool {
+	return a < b+bSize && b < a+aSize
+}
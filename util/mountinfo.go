@@ -0,0 +1,151 @@
+package util
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// a line of /proc/self/mountinfo, see proc_pid_mountinfo(5)
+type MountInfo struct {
+	MountPoint string
+	Options    []string // per-mount options
+	FsType     string
+}
+
+func ReadMountInfo() ([]MountInfo, error) {
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var mounts []MountInfo
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		sep := slices.Index(fields, "-")
+		if len(fields) < 6 || sep < 6 || sep+1 >= len(fields) {
+			return nil, fmt.Errorf("malformed mountinfo line '%s'", scanner.Text())
+		}
+
+		mounts = append(mounts, MountInfo{
+			MountPoint: unescapeMountInfo(fields[4]),
+			Options:    strings.Split(fields[5], ","),
+			FsType:     fields[sep+1],
+		})
+	}
+
+	return mounts, scanner.Err()
+}
+
+// visible mounts at or beneath target
+func mountsUnder(target string, recursive bool) ([]MountInfo, error) {
+	mounts, err := ReadMountInfo()
+	if err != nil {
+		return nil, err
+	}
+
+	var found []MountInfo
+	for _, m := range mounts {
+		below := strings.HasPrefix(m.MountPoint, target+"/")
+		if m.MountPoint != target && !(recursive && below) {
+			continue
+		}
+
+		// a later mount on the same point is stacked on top
+		found = slices.DeleteFunc(found, func(prev MountInfo) bool {
+			return prev.MountPoint == m.MountPoint
+		})
+		found = append(found, m)
+	}
+
+	if len(found) == 0 {
+		return nil, fmt.Errorf("%s is not a mount point", target)
+	}
+
+	return found, nil
+}
+
+// Remount applies per-mount flags to target, and everything mounted beneath
+// it when recursive. Flags other than propagation are ignored by the kernel
+// on the initial bind.
+func Remount(target string, flags uintptr, recursive bool) error {
+	target, err := absMountPoint(target)
+	if err != nil {
+		return err
+	}
+
+	mounts, err := mountsUnder(target, recursive)
+	if err != nil {
+		return err
+	}
+
+	flags |= syscall.MS_REMOUNT | syscall.MS_BIND
+	for _, m := range mounts {
+		if err := syscall.Mount("", m.MountPoint, "", flags, ""); err != nil {
+			return fmt.Errorf("failed to remount %s %v", m.MountPoint, err)
+		}
+	}
+
+	return nil
+}
+
+// VerifyMount checks that every mount at target, and beneath it when
+// recursive, carries options.
+func VerifyMount(target string, options []string, recursive bool) error {
+	target, err := absMountPoint(target)
+	if err != nil {
+		return err
+	}
+
+	mounts, err := mountsUnder(target, recursive)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range mounts {
+		for _, opt := range options {
+			if !slices.Contains(m.Options, opt) {
+				return fmt.Errorf("mount %s is missing option %s", m.MountPoint, opt)
+			}
+		}
+	}
+
+	return nil
+}
+
+func absMountPoint(target string) (string, error) {
+	target, err := filepath.Abs(target)
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.EvalSymlinks(target)
+}
+
+// mountinfo escapes space, tab, newline and backslash as octal
+func unescapeMountInfo(s string) string {
+	if !strings.Contains(s, "\\") {
+		return s
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+4 <= len(s) {
+			if c, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(c))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+
+	return b.String()
+}
@@ -0,0 +1,132 @@
+// Package pty allocates pseudo-terminals and manipulates terminal modes.
+package pty
+
+import (
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// Open allocates a new pseudo-terminal pair from /dev/ptmx. The slave end
+// is opened without becoming the controlling terminal of the caller.
+func Open() (master *os.File, slave *os.File, err error) {
+	master, err = os.OpenFile("/dev/ptmx", os.O_RDWR|unix.O_NOCTTY, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var n uint32
+	err = control(master, func(fd int) error {
+		if err := unix.IoctlSetPointerInt(fd, unix.TIOCSPTLCK, 0); err != nil {
+			return fmt.Errorf("failed to unlock pty %v", err)
+		}
+
+		n, err = unix.IoctlGetUint32(fd, unix.TIOCGPTN)
+		return err
+	})
+	if err != nil {
+		master.Close()
+		return nil, nil, err
+	}
+
+	slave, err = os.OpenFile(fmt.Sprintf("/dev/pts/%d", n), os.O_RDWR|unix.O_NOCTTY, 0)
+	if err != nil {
+		master.Close()
+		return nil, nil, err
+	}
+
+	return master, slave, nil
+}
+
+// IsTerminal reports whether f refers to a terminal.
+func IsTerminal(f *os.File) bool {
+	err := control(f, func(fd int) error {
+		_, err := unix.IoctlGetTermios(fd, unix.TCGETS)
+		return err
+	})
+	return err == nil
+}
+
+// GetSize returns the window size of terminal f.
+func GetSize(f *os.File) (*unix.Winsize, error) {
+	var ws *unix.Winsize
+	err := control(f, func(fd int) (err error) {
+		ws, err = unix.IoctlGetWinsize(fd, unix.TIOCGWINSZ)
+		return err
+	})
+	return ws, err
+}
+
+// SetSize sets the window size of terminal f. The kernel notifies the
+// foreground process group of the terminal with SIGWINCH.
+func SetSize(f *os.File, ws *unix.Winsize) error {
+	return control(f, func(fd int) error {
+		return unix.IoctlSetWinsize(fd, unix.TIOCSWINSZ, ws)
+	})
+}
+
+// InheritSize copies the window size of terminal from to terminal to.
+func InheritSize(from, to *os.File) error {
+	ws, err := GetSize(from)
+	if err != nil {
+		return err
+	}
+
+	return SetSize(to, ws)
+}
+
+// MakeRaw puts terminal f into raw mode and returns its previous state
+// to be passed to Restore.
+func MakeRaw(f *os.File) (*unix.Termios, error) {
+	var old unix.Termios
+	err := control(f, func(fd int) error {
+		termios, err := unix.IoctlGetTermios(fd, unix.TCGETS)
+		if err != nil {
+			return err
+		}
+		old = *termios
+
+		// see cfmakeraw(3)
+		termios.Iflag &^= unix.IGNBRK | unix.BRKINT | unix.PARMRK | unix.ISTRIP | unix.INLCR | unix.IGNCR | unix.ICRNL | unix.IXON
+		termios.Oflag &^= unix.OPOST
+		termios.Lflag &^= unix.ECHO | unix.ECHONL | unix.ICANON | unix.ISIG | unix.IEXTEN
+		termios.Cflag &^= unix.CSIZE | unix.PARENB
+		termios.Cflag |= unix.CS8
+		termios.Cc[unix.VMIN] = 1
+		termios.Cc[unix.VTIME] = 0
+
+		return unix.IoctlSetTermios(fd, unix.TCSETS, termios)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &old, nil
+}
+
+// Restore sets terminal f back to a state returned by MakeRaw.
+func Restore(f *os.File, state *unix.Termios) error {
+	return control(f, func(fd int) error {
+		return unix.IoctlSetTermios(fd, unix.TCSETS, state)
+	})
+}
+
+// control runs fn against the raw descriptor of f without switching f
+// into blocking mode as (*os.File).Fd would.
+func control(f *os.File, fn func(fd int) error) error {
+	conn, err := f.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var fnErr error
+	err = conn.Control(func(fd uintptr) {
+		fnErr = fn(int(fd))
+	})
+	if err != nil {
+		return err
+	}
+
+	return fnErr
+}
@@ -0,0 +1,52 @@
+package util
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/rand/v2"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// ServeRandom creates a fifo at path fed with a ChaCha8 stream seeded with
+// seed. The fifo is held open on both ends so the stream carries on from
+// one reader to the next, the bytes read over a run are the same as long
+// as they are read in the same order. The returned func stops feeding it.
+func ServeRandom(path string, seed uint64) (func(), error) {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to replace %s %v", path, err)
+	}
+
+	if err := unix.Mkfifo(path, 0o444); err != nil {
+		return nil, fmt.Errorf("failed to create fifo %s %v", path, err)
+	}
+
+	// mkfifo is subject to umask
+	if err := os.Chmod(path, 0o444); err != nil {
+		return nil, err
+	}
+
+	// a fifo opened for both never blocks in open nor breaks on write
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open fifo %s %v", path, err)
+	}
+
+	var key [32]byte
+	binary.LittleEndian.PutUint64(key[:], seed)
+	stream := rand.NewChaCha8(key)
+
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			stream.Read(buf)
+			// fails once closed
+			if _, err := f.Write(buf); err != nil {
+				return
+			}
+		}
+	}()
+
+	return func() { f.Close() }, nil
+}
@@ -8,11 +8,13 @@ import (
 	"path/filepath"
 	"runtime"
 	"strconv"
+	"strings"
 	"syscall"
 
 	"codeberg.org/iklabib/kaleng/configs"
 	"codeberg.org/iklabib/kaleng/model"
 	"codeberg.org/iklabib/kaleng/util/fastrand"
+	"golang.org/x/sys/unix"
 )
 
 func Bail(err error) {
@@ -21,16 +23,46 @@ func Bail(err error) {
 	}
 }
 
+// Report writes the result of a failed run. The supervisor points it at
+// the session so failures come out in the format of the output mode, it
+// must not bail itself.
+var Report = func(res model.Result) {
+	v, _ := json.Marshal(res)
+	fmt.Println(string(v))
+}
+
 func MessageBail(msg string) {
 	res := model.Result{
 		Output: msg,
 		Metric: model.Metrics{ExitCode: -1},
 	}
-	v, _ := json.Marshal(res)
-	fmt.Println(string(v))
+	Report(res)
 	runtime.Goexit()
 }
 
+// marks what Warn writes so the supervisor can pick it out of stderr
+const warningPrefix = "kaleng: warning: "
+
+// Warn reports a degraded restriction without failing the run
+func Warn(msg string) {
+	fmt.Fprintf(os.Stderr, "%s%s\n", warningPrefix, msg)
+}
+
+// SplitWarnings separates the messages Warn wrote to out from the rest
+func SplitWarnings(out string) ([]string, string) {
+	var warnings []string
+	var rest strings.Builder
+	for _, line := range strings.SplitAfter(out, "\n") {
+		if msg, ok := strings.CutPrefix(line, warningPrefix); ok {
+			warnings = append(warnings, strings.TrimSuffix(msg, "\n"))
+			continue
+		}
+		rest.WriteString(line)
+	}
+
+	return warnings, rest.String()
+}
+
 func MountProc(path string) {
 	procPath := filepath.Join(path, "proc")
 
@@ -44,13 +76,101 @@ func MountProc(path string) {
 	Bail(err)
 }
 
+// MountFreshProc stacks a procfs of the current PID namespace over /proc,
+// it has to run inside the mount namespace.
+func MountFreshProc() {
+	var flags uintptr = syscall.MS_NOSUID | syscall.MS_NODEV | syscall.MS_NOEXEC
+	if err := syscall.Mount("proc", "/proc", "proc", flags, "hidepid=2"); err != nil {
+		Bail(fmt.Errorf("failed to mount procfs %s", err.Error()))
+	}
+}
+
+// MaskPath hides a file behind /dev/null and a directory behind an empty
+// read-only tmpfs. Missing paths are ignored.
+func MaskPath(path string) {
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return
+	}
+	Bail(err)
+
+	if info.IsDir() {
+		err = syscall.Mount("tmpfs", path, "tmpfs", syscall.MS_RDONLY|syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_NOEXEC, "size=0")
+	} else {
+		err = syscall.Mount("/dev/null", path, "", syscall.MS_BIND, "")
+	}
+
+	if err != nil {
+		Bail(fmt.Errorf("failed to mask %s %s", path, err.Error()))
+	}
+}
+
+// ReadonlyPath binds path over itself and remounts it read-only. Missing
+// paths are ignored.
+func ReadonlyPath(path string) {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return
+	}
+
+	if err := syscall.Mount(path, path, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+		Bail(fmt.Errorf("failed to bind %s %s", path, err.Error()))
+	}
+
+	var flags uintptr = syscall.MS_RDONLY | syscall.MS_NOSUID | syscall.MS_NODEV | syscall.MS_NOEXEC
+	if err := Remount(path, flags, true); err != nil {
+		Bail(err)
+	}
+}
+
 func BindMount(parent string, bind configs.Bind) {
 	target := filepath.Join(parent, bind.Target)
-	var flags uintptr = syscall.MS_BIND | syscall.MS_NODEV | syscall.MS_PRIVATE | syscall.MS_NOSUID
+	var flags uintptr = syscall.MS_BIND
+	if bind.Recursive {
+		flags |= syscall.MS_REC
+	}
+
 	err := syscall.Mount(bind.Source, target, bind.FsType, flags, bind.Data)
 	if err != nil {
 		Bail(fmt.Errorf("failed to bind mount %s %s", bind.Source, err.Error()))
 	}
+
+	// propagation has to be changed on its own
+	err = syscall.Mount("", target, "", flags&syscall.MS_REC|syscall.MS_PRIVATE, "")
+	if err != nil {
+		Bail(fmt.Errorf("failed to make %s private %s", bind.Source, err.Error()))
+	}
+
+	options := []string{"nosuid", "nodev"}
+	flags = syscall.MS_NOSUID | syscall.MS_NODEV
+	if bind.Readonly {
+		flags |= syscall.MS_RDONLY
+		options = append(options, "ro")
+	}
+
+	if bind.NoExec {
+		flags |= syscall.MS_NOEXEC
+		options = append(options, "noexec")
+	}
+
+	if err := Remount(target, flags, bind.Recursive); err != nil {
+		Bail(err)
+	}
+
+	if err := VerifyMount(target, options, bind.Recursive); err != nil {
+		Bail(fmt.Errorf("bind mount %s not restricted %s", bind.Source, err.Error()))
+	}
+}
+
+// PrivateMount binds path over itself as a private mount, what is mounted
+// beneath it afterwards has no peers
+func PrivateMount(path string) {
+	if err := syscall.Mount(path, path, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+		Bail(fmt.Errorf("failed to bind %s %s", path, err.Error()))
+	}
+
+	if err := syscall.Mount("", path, "", syscall.MS_PRIVATE|syscall.MS_REC, ""); err != nil {
+		Bail(fmt.Errorf("failed to make %s private %s", path, err.Error()))
+	}
 }
 
 func BindUnmount(target string) {
@@ -64,35 +184,92 @@ func CopyRootFs(source, target string) {
 	}
 }
 
-var devices = map[string]os.FileMode{
-	"/dev/null":    0o666,
-	"/dev/zero":    0o666,
-	"/dev/full":    0o666,
-	"/dev/urandom": 0o444,
+// links every /dev is expected to have
+var devLinks = map[string]string{
+	"/dev/fd":     "/proc/self/fd",
+	"/dev/stdin":  "/proc/self/fd/0",
+	"/dev/stdout": "/proc/self/fd/1",
+	"/dev/stderr": "/proc/self/fd/2",
+	"/dev/ptmx":   "pts/ptmx",
 }
 
-func MountBindDev(path string) {
-	os.Mkdir(filepath.Join(path, "dev"), 0o751)
+// MountBindDev populates /dev with devices, a private devpts instance and
+// shm. Devices are created as nodes with their configured mode, or bound
+// from the host when the root does not allow nodes.
+func MountBindDev(path string, devices []configs.Device, shm configs.Tmpfs) {
+	devPath := filepath.Join(path, "dev")
+	if err := os.Mkdir(devPath, 0o751); err != nil && !os.IsExist(err) {
+		MessageBail(fmt.Sprintf("device: failed to create /dev %v", err))
+	}
+
+	var stat unix.Statfs_t
+	if err := unix.Statfs(devPath, &stat); err != nil {
+		MessageBail(fmt.Sprintf("device: failed to stat /dev %v", err))
+	}
+	nodev := stat.Flags&unix.ST_NODEV != 0
+
+	for _, dev := range devices {
+		var host unix.Stat_t
+		if err := unix.Stat(dev.Path, &host); err != nil {
+			if dev.Optional && os.IsNotExist(err) {
+				continue
+			}
+			MessageBail(fmt.Sprintf("device: %s %v", dev.Path, err))
+		}
 
-	for dev, mode := range devices {
-		target := filepath.Join(path, dev)
-		f, err := os.Create(target)
+		mode, err := dev.FileMode()
 		Bail(err)
-		defer f.Close()
 
-		Bail(os.Chmod(target, mode))
+		target := filepath.Join(path, dev.Path)
+		if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+			MessageBail(fmt.Sprintf("device: failed to create %s %v", filepath.Dir(dev.Path), err))
+		}
+
+		// a leftover from the rootfs would shadow the device
+		if err := os.Remove(target); err != nil && !os.IsNotExist(err) {
+			MessageBail(fmt.Sprintf("device: failed to replace %s %v", dev.Path, err))
+		}
+
+		if !nodev {
+			err := unix.Mknod(target, host.Mode&unix.S_IFMT|mode, int(host.Rdev))
+			if err == nil {
+				// mknod is subject to umask
+				Bail(os.Chmod(target, os.FileMode(mode)))
+				continue
+			}
+		}
+
+		f, err := os.OpenFile(target, os.O_CREATE|os.O_EXCL, os.FileMode(mode))
+		if err != nil {
+			MessageBail(fmt.Sprintf("device: failed to create %s %v", dev.Path, err))
+		}
+		f.Close()
 
-		err = syscall.Mount(dev, target, "", syscall.MS_BIND, "")
+		err = syscall.Mount(dev.Path, target, "", syscall.MS_BIND, "")
 		if err != nil {
-			MessageBail(fmt.Sprintf("device: failed to bind %s to %s %v", dev, target, err))
+			MessageBail(fmt.Sprintf("device: failed to bind %s to %s %v", dev.Path, target, err))
 		}
 	}
 
-	// create shm
-	err := os.Mkdir(filepath.Join(path, "/dev/shm"), 0o1777)
+	ptsPath := filepath.Join(devPath, "pts")
+	if err := os.Mkdir(ptsPath, 0o755); err != nil && !os.IsExist(err) {
+		MessageBail(fmt.Sprintf("device: failed to create /dev/pts %v", err))
+	}
+
+	// a new instance keeps host terminals out of reach
+	err := syscall.Mount("devpts", ptsPath, "devpts", syscall.MS_NOSUID|syscall.MS_NOEXEC, "newinstance,ptmxmode=0666,mode=0620")
 	if err != nil {
-		MessageBail(fmt.Sprintf("device: failed to create /dev/shm %v", err))
+		MessageBail(fmt.Sprintf("device: failed to mount /dev/pts %v", err))
 	}
+
+	for link, dest := range devLinks {
+		err := os.Symlink(dest, filepath.Join(path, link))
+		if err != nil && !os.IsExist(err) {
+			MessageBail(fmt.Sprintf("device: failed to link %s %v", link, err))
+		}
+	}
+
+	MountTmpfs(path, shm)
 }
 
 func UnmoutProc(path string) {
@@ -107,29 +284,49 @@ func UnmountCGroup(path string) {
 	Bail(err)
 }
 
-func UnmoutDev(path string) {
-	for dev := range devices {
-		devPath := filepath.Join(path, dev)
+func UnmoutDev(path string, devices []configs.Device, shm configs.Tmpfs) {
+	for _, dev := range devices {
+		devPath := filepath.Join(path, dev.Path)
 		err := syscall.Unmount(devPath, syscall.MNT_DETACH)
-		if err != nil {
-			MessageBail(fmt.Sprintf("device: failed to unmount %s %v", dev, err))
+		// nodes and skipped devices are not mounts
+		if err != nil && err != syscall.EINVAL && err != syscall.ENOENT {
+			MessageBail(fmt.Sprintf("device: failed to unmount %s %v", dev.Path, err))
 		}
 	}
 
-	// create shm
-	err := os.RemoveAll(filepath.Join(path, "/dev/shm"))
+	err := syscall.Unmount(filepath.Join(path, "dev/pts"), syscall.MNT_DETACH)
 	if err != nil {
-		MessageBail(fmt.Sprintf("device: failed to remove /dev/shm %v", err))
+		MessageBail(fmt.Sprintf("device: failed to unmount /dev/pts %v", err))
 	}
+
+	BindUnmount(filepath.Join(path, shm.Path))
 }
 
-func MountMnt(path string, size uint) {
-	tmpPath := filepath.Join(path, "tmp")
-	os.MkdirAll(tmpPath, 0o777)
-	var flags uintptr = syscall.MS_NODEV | syscall.MS_NOSUID | syscall.MS_NOSUID
-	data := fmt.Sprintf("size=%d,mode=1777", size)
-	err := syscall.Mount("tmpfs", tmpPath, "tmpfs", flags, data)
+func MountTmpfs(path string, tmpfs configs.Tmpfs) {
+	target := filepath.Join(path, tmpfs.Path)
+	Bail(os.MkdirAll(target, 0o755))
+
+	var flags uintptr = syscall.MS_NODEV | syscall.MS_NOSUID
+	if tmpfs.NoExec {
+		flags |= syscall.MS_NOEXEC
+	}
+
+	mode, err := tmpfs.FileMode()
 	Bail(err)
+
+	data := fmt.Sprintf("mode=%o", mode)
+	if tmpfs.Size > 0 {
+		data += fmt.Sprintf(",size=%d", tmpfs.Size)
+	}
+
+	if tmpfs.Inodes > 0 {
+		data += fmt.Sprintf(",nr_inodes=%d", tmpfs.Inodes)
+	}
+
+	err = syscall.Mount("tmpfs", target, "tmpfs", flags, data)
+	if err != nil {
+		Bail(fmt.Errorf("failed to mount tmpfs %s %s", tmpfs.Path, err.Error()))
+	}
 }
 
 func MountCGroupV2(path string) {